@@ -0,0 +1,92 @@
+// Package client is a Go client for the HTTP API of the key-value storage
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Client sends requests to one node of the cluster,
+// followers forward writes to the leader, so any node can be used
+type Client struct {
+	address    string
+	httpClient *http.Client
+}
+
+// Error is an error response of the API
+type Error struct {
+	Status  int
+	Code    string `json:"code"`
+	Message string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// NewClient returns a client for the node with HTTP address "host:port"
+func NewClient(address string) *Client {
+	return &Client{
+		address: address,
+		// lock acquisition may wait up to 10 minutes on the server
+		httpClient: &http.Client{Timeout: time.Minute * 11},
+	}
+}
+
+// do sends a JSON request and decodes the JSON response into result,
+// responses with status other than 200 are returned as *Error
+func (c *Client) do(method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", c.address, path), reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		apiErr := &Error{Status: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(apiErr)
+		return apiErr
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// GrantLease creates a new lease with the TTL and returns its ID
+func (c *Client) GrantLease(ttl time.Duration) (uint64, error) {
+	var response struct {
+		ID uint64 `json:"id"`
+	}
+	err := c.do("POST", "/leases/", map[string]string{"ttl": ttl.String()}, &response)
+	return response.ID, err
+}
+
+// KeepAliveLease renews the lease
+func (c *Client) KeepAliveLease(id uint64) error {
+	return c.do("POST", fmt.Sprintf("/leases/%d/keepalive/", id), nil, nil)
+}
+
+// RevokeLease deletes the lease and all keys attached to it
+func (c *Client) RevokeLease(id uint64) error {
+	return c.do("DELETE", fmt.Sprintf("/leases/%d/", id), nil, nil)
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Lock is a held distributed lock
+type Lock struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+	Lease uint64 `json:"lease"`
+	// Token is a fencing token: it increases with every acquisition of the lock,
+	// pass it to downstream systems so they can reject requests of stale lock holders
+	Token uint64 `json:"token"`
+}
+
+// AcquireLock acquires the lock for the lease, waiting for it up to wait.
+// Returns *Error with code "lock_held" if the lock is still held by another lease
+func (c *Client) AcquireLock(name string, lease uint64, owner string, wait time.Duration) (*Lock, error) {
+	path := fmt.Sprintf("/locks/%s/acquire/", url.PathEscape(name))
+	if wait > 0 {
+		path += "?wait=" + wait.String()
+	}
+
+	var lock Lock
+	err := c.do("POST", path, map[string]interface{}{"lease": lease, "owner": owner}, &lock)
+	if err != nil {
+		return nil, err
+	}
+	return &lock, nil
+}
+
+// ReleaseLock releases the lock if it is still held with the lock's token
+func (c *Client) ReleaseLock(lock *Lock) error {
+	path := fmt.Sprintf("/locks/%s/release/", url.PathEscape(lock.Name))
+	return c.do("POST", path, map[string]uint64{"token": lock.Token}, nil)
+}
+
+// Session is a lease which is kept alive in background,
+// locks acquired in the session are released if the process dies and stops the keepalives
+type Session struct {
+	client *Client
+	// LeaseID is the ID of the session's lease
+	LeaseID uint64
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSession grants a lease with the TTL and starts keeping it alive every ttl/3
+func NewSession(client *Client, ttl time.Duration) (*Session, error) {
+	id, err := client.GrantLease(ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		client:  client,
+		LeaseID: id,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go session.keepAlive(ttl / 3)
+	return session, nil
+}
+
+// keepAlive renews the lease until the session is closed or the lease is lost
+func (s *Session) keepAlive(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := s.client.KeepAliveLease(s.LeaseID)
+		if apiErr, ok := err.(*Error); ok && apiErr.Code == "lease_not_found" {
+			log.Printf("[ERROR] Session lease %d is lost", s.LeaseID)
+			return
+		}
+		if err != nil {
+			// the lease may still be alive, retry with the next tick
+			log.Printf("[ERROR] Can't keep session lease %d alive: %+v", s.LeaseID, err)
+		}
+	}
+}
+
+// Done is closed when the session's lease is lost or the session is closed,
+// locks acquired in the session must not be used after that
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Lock acquires the lock in the session
+func (s *Session) Lock(name string, owner string, wait time.Duration) (*Lock, error) {
+	return s.client.AcquireLock(name, s.LeaseID, owner, wait)
+}
+
+// Close stops the keepalives and revokes the lease, all locks of the session are released
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+	return s.client.RevokeLease(s.LeaseID)
+}
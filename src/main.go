@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/jessevdk/go-flags"
@@ -14,10 +17,18 @@ import (
 
 // Opts represents command line options
 type Opts struct {
-	BindAddress string `long:"bind" env:"BIND" default:"127.0.0.1:3000" description:"ip:port to bind for a node"`
-	JoinAddress string `long:"join" env:"JOIN" default:"" description:"ip:port to join for a node"`
-	Bootstrap   bool   `long:"bootstrap" env:"BOOTSTRAP" description:"bootstrap a cluster"`
-	DataDir     string `long:"datadir" env:"DATA_DIR" default:"/tmp/data/" description:"Where to store system data"`
+	BindAddress   string        `long:"bind" env:"BIND" default:"127.0.0.1:3000" description:"ip:port to bind for a node"`
+	NodeID        string        `long:"id" env:"IDENTIFIER" default:"" description:"stable ID of the node, stored in the data dir on the first start (default: bind address)"`
+	JoinAddress   string        `long:"join" env:"JOIN" default:"" description:"ip:port to join for a node"`
+	Bootstrap     bool          `long:"bootstrap" env:"BOOTSTRAP" description:"bootstrap a cluster"`
+	DataDir       string        `long:"datadir" env:"DATA_DIR" default:"/tmp/data/" description:"Where to store system data"`
+	BatchSize     int           `long:"batch-size" env:"BATCH_SIZE" default:"64" description:"maximum number of writes in one Raft log entry, 1 disables batching"`
+	BatchLinger   time.Duration `long:"batch-linger" env:"BATCH_LINGER" default:"0s" description:"how long to wait for more writes before sending a batch"`
+	MinVoters     int           `long:"min-voters" env:"MIN_VOTERS" default:"1" description:"servers can't be removed if the cluster would have less voters"`
+	Nonvoter      bool          `long:"nonvoter" env:"NONVOTER" description:"join the cluster as a non-voting read replica"`
+	Leave         bool          `long:"leave-on-shutdown" env:"LEAVE_ON_SHUTDOWN" description:"remove the node from the cluster when it is stopped with SIGINT or SIGTERM"`
+	HTTPBind      string        `long:"http-bind" env:"HTTP_BIND" default:":8080" description:"ip:port to serve HTTP on"`
+	HTTPAdvertise string        `long:"http-advertise" env:"HTTP_ADVERTISE" default:"" description:"ip:port other nodes use to reach the HTTP server (default: host of --bind with the port of --http-bind)"`
 }
 
 func main() {
@@ -36,12 +47,23 @@ func main() {
 
 	log.Printf("[INFO] '%s' is used to store files of the node", opts.DataDir)
 
+	httpAdvertise, err := httpAdvertiseAddress(opts)
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Printf("[INFO] HTTP address of the node is %s", httpAdvertise)
+
 	config := node.Config{
-		BindAddress:    opts.BindAddress,
-		NodeIdentifier: opts.BindAddress,
-		JoinAddress:    opts.JoinAddress,
-		DataDir:        opts.DataDir,
-		Bootstrap:      opts.Bootstrap,
+		BindAddress:          opts.BindAddress,
+		NodeIdentifier:       opts.NodeID,
+		JoinAddress:          opts.JoinAddress,
+		DataDir:              opts.DataDir,
+		Bootstrap:            opts.Bootstrap,
+		MaxBatchSize:         opts.BatchSize,
+		BatchLinger:          opts.BatchLinger,
+		MinVoters:            opts.MinVoters,
+		Nonvoter:             opts.Nonvoter,
+		HTTPAdvertiseAddress: httpAdvertise,
 	}
 	storage, err := node.NewRStorage(&config)
 	if err != nil {
@@ -52,6 +74,7 @@ func main() {
 	log.Println(msg)
 
 	go printStatus(storage)
+	go shutdownOnSignal(storage, opts.Leave)
 
 	// If JoinAddress is not nil and there is no cluster, we have to send a POST request to this address
 	// It must be an address of the cluster leader
@@ -69,7 +92,49 @@ func main() {
 	}
 
 	// Start an HTTP server
-	server.RunHTTPServer(storage)
+	if err := server.RunHTTPServer(storage, opts.HTTPBind); err != nil {
+		log.Panic(err)
+	}
+}
+
+// httpAdvertiseAddress returns --http-advertise if it is set, otherwise --http-bind.
+// If --http-bind doesn't have a host or binds all interfaces, the host of the Raft address is used
+func httpAdvertiseAddress(opts Opts) (string, error) {
+	if opts.HTTPAdvertise != "" {
+		return opts.HTTPAdvertise, nil
+	}
+	host, port, err := net.SplitHostPort(opts.HTTPBind)
+	if err != nil {
+		return "", fmt.Errorf("Invalid HTTP bind address %s: %v", opts.HTTPBind, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host, _, err = net.SplitHostPort(opts.BindAddress)
+		if err != nil {
+			return "", fmt.Errorf("Invalid bind address %s: %v", opts.BindAddress, err)
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// shutdownOnSignal stops the node on SIGINT or SIGTERM,
+// if leave is true, the node is removed from the cluster first
+func shutdownOnSignal(s *node.RStorage, leave bool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("[INFO] Received %s, shutting down", sig)
+
+	if leave {
+		if err := server.Leave(s); err != nil {
+			log.Printf("[ERROR] Can't leave the cluster: %+v", err)
+		} else {
+			log.Printf("[INFO] Node left the cluster")
+		}
+	}
+	if err := s.RaftNode.Shutdown().Error(); err != nil {
+		log.Printf("[ERROR] Can't shut down Raft: %+v", err)
+	}
+	os.Exit(0)
 }
 
 func printStatus(s *node.RStorage) {
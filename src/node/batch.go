@@ -0,0 +1,169 @@
+package node
+
+import (
+	"log"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// maxBatchBytes limits the size of values in one batch,
+	// a single bigger write is still sent alone
+	maxBatchBytes = 1024 * 1024
+	// batcherShutdownInterval is how often an idle runBatcher checks whether Raft is shut down
+	batcherShutdownInterval = time.Second
+)
+
+// batchableEvents are event types which can share a Raft log entry with other writes
+var batchableEvents = map[string]bool{
+	"set":    true,
+	"cas":    true,
+	"delete": true,
+	"incr":   true,
+}
+
+// pendingEvent is a write waiting to be sent to the Raft log in a batch
+type pendingEvent struct {
+	event *logEvent
+	// done receives the FSM response of the event
+	done chan batchResponse
+}
+
+type batchResponse struct {
+	response interface{}
+	err      error
+}
+
+// applyBatched sends event to runBatcher and waits for its FSM response
+func (s *RStorage) applyBatched(event *logEvent) (interface{}, error) {
+	pending := &pendingEvent{event: event, done: make(chan batchResponse, 1)}
+	select {
+	case s.batchCh <- pending:
+	case <-time.After(applyTimeout):
+		return nil, ErrTimeout
+	}
+	result := <-pending.done
+	return result.response, result.err
+}
+
+// runBatcher groups concurrent writes into "batch" log entries.
+// It takes writes which are already waiting, up to config.MaxBatchSize,
+// and waits up to config.BatchLinger for more before sending the batch.
+// A batch never contains two writes of the same key, so every key still gets
+// a unique revision. Batches are pipelined: the next batch is collected
+// while the previous one is being committed. It returns when Raft is shut down
+func (s *RStorage) runBatcher() {
+	ticker := time.NewTicker(batcherShutdownInterval)
+	defer ticker.Stop()
+
+	var next *pendingEvent
+	for {
+		if next == nil {
+			select {
+			case next = <-s.batchCh:
+			case <-ticker.C:
+				if s.RaftNode.State() == raft.Shutdown {
+					return
+				}
+				continue
+			}
+		}
+		var batch []*pendingEvent
+		batch, next = s.collectBatch(next)
+		s.proposeBatch(batch)
+	}
+}
+
+// collectBatch returns a batch which starts with first,
+// and the write which didn't fit into the batch if any
+func (s *RStorage) collectBatch(first *pendingEvent) ([]*pendingEvent, *pendingEvent) {
+	batch := []*pendingEvent{first}
+	keys := map[string]bool{first.event.Key: true}
+	size := len(first.event.Data)
+
+	var linger <-chan time.Time
+	if s.config.BatchLinger > 0 {
+		timer := time.NewTimer(s.config.BatchLinger)
+		defer timer.Stop()
+		linger = timer.C
+	}
+
+	for len(batch) < s.config.MaxBatchSize {
+		var pending *pendingEvent
+		if linger == nil {
+			select {
+			case pending = <-s.batchCh:
+			default:
+				return batch, nil
+			}
+		} else {
+			select {
+			case pending = <-s.batchCh:
+			case <-linger:
+				return batch, nil
+			}
+		}
+
+		if keys[pending.event.Key] || size+len(pending.event.Data) > maxBatchBytes {
+			return batch, pending
+		}
+		keys[pending.event.Key] = true
+		size += len(pending.event.Data)
+		batch = append(batch, pending)
+	}
+	return batch, nil
+}
+
+// proposeBatch writes the batch to the Raft log and sends each write its own result
+// when the entry is applied, it doesn't wait for the commit
+func (s *RStorage) proposeBatch(batch []*pendingEvent) {
+	reply := func(i int, response interface{}, err error) {
+		batch[i].done <- batchResponse{response: response, err: err}
+	}
+	replyAll := func(err error) {
+		for i := range batch {
+			reply(i, nil, err)
+		}
+	}
+
+	event := batch[0].event
+	if len(batch) > 1 {
+		event = &logEvent{Type: "batch", Time: time.Now().UnixNano()}
+		for _, pending := range batch {
+			event.Batch = append(event.Batch, pending.event)
+		}
+		log.Printf("[DEBUG] Sending a batch of %d writes", len(batch))
+	}
+
+	data, err := encodeLogEvent(event)
+	if err != nil {
+		replyAll(err)
+		return
+	}
+	future := s.RaftNode.Apply(data, applyTimeout)
+
+	go func() {
+		if err := future.Error(); err != nil {
+			replyAll(translateRaftError(err))
+			return
+		}
+
+		response := future.Response()
+		if len(batch) == 1 {
+			reply(0, response, nil)
+			return
+		}
+		results, ok := response.([]interface{})
+		if !ok {
+			// the whole entry failed, e.g. it couldn't be decoded
+			for i := range batch {
+				reply(i, response, nil)
+			}
+			return
+		}
+		for i := range batch {
+			reply(i, results[i], nil)
+		}
+	}()
+}
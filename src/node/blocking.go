@@ -0,0 +1,75 @@
+package node
+
+import (
+	"time"
+)
+
+// keyWaiter is shared by all blocking queries waiting for changes of the same key,
+// ch is closed when the key changes
+type keyWaiter struct {
+	ch      chan struct{}
+	waiters int
+}
+
+// notifyKey wakes up blocking queries waiting for changes of the key, s.mutex must be held
+func (s *RStorage) notifyKey(key string) {
+	if waiter, ok := s.keyWaiters[key]; ok {
+		close(waiter.ch)
+		delete(s.keyWaiters, key)
+	}
+}
+
+// notifyAllKeys wakes up all blocking queries, it is used when the whole storage is replaced
+// s.mutex must be held
+func (s *RStorage) notifyAllKeys() {
+	for key := range s.keyWaiters {
+		s.notifyKey(key)
+	}
+}
+
+// WaitForKeyChange blocks until the modification index of the key differs from index,
+// the timeout expires or cancel is closed, and returns the current value of the key.
+// Missing keys have index 0, so with index 0 it waits until the key is created.
+// s.mutex is not held while waiting
+func (s *RStorage) WaitForKeyChange(key string, index uint64, cancel <-chan struct{}, timeout time.Duration) (KeyValue, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.mutex.Lock()
+		kv, exists := s.getKey(key, time.Now().UnixNano())
+		if kv.ModifyIndex != index {
+			s.mutex.Unlock()
+			return kv, exists
+		}
+		waiter, ok := s.keyWaiters[key]
+		if !ok {
+			waiter = &keyWaiter{ch: make(chan struct{})}
+			s.keyWaiters[key] = waiter
+		}
+		waiter.waiters++
+		s.mutex.Unlock()
+
+		stopped := false
+		select {
+		case <-waiter.ch:
+		case <-timer.C:
+			stopped = true
+		case <-cancel:
+			stopped = true
+		}
+
+		s.mutex.Lock()
+		waiter.waiters--
+		// the waiter is already removed from the map if the key changed
+		if waiter.waiters == 0 && s.keyWaiters[key] == waiter {
+			delete(s.keyWaiters, key)
+		}
+		if stopped {
+			kv, exists = s.getKey(key, time.Now().UnixNano())
+			s.mutex.Unlock()
+			return kv, exists
+		}
+		s.mutex.Unlock()
+	}
+}
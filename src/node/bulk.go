@@ -0,0 +1,155 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// maxBulkEntryOps limits the number of operations of a bulk write in one Raft log entry
+const maxBulkEntryOps = 1000
+
+var (
+	// ErrBulkTooLarge is returned when an atomic bulk write doesn't fit into one Raft log entry
+	ErrBulkTooLarge = errors.New("Atomic bulk write is too large for one Raft log entry")
+	// ErrBulkAborted is returned for operations of an atomic bulk write
+	// which are not applied because another operation failed
+	ErrBulkAborted = errors.New("Operation is not applied because another operation of the atomic bulk write failed")
+)
+
+// BulkOp is an operation of a bulk write
+type BulkOp struct {
+	// Type is "set" or "delete"
+	Type  string
+	Key   string
+	Value []byte
+	TTL   time.Duration
+	Lease uint64
+}
+
+// BulkResult is a result of one operation of a bulk write
+type BulkResult struct {
+	// Index is the index of the Raft log entry which applied the operation
+	Index uint64
+	// Deleted reports whether the key existed for "delete" operations
+	Deleted bool
+	// Err is the reason why the operation is not applied
+	Err error
+}
+
+// Bulk writes many keys with as few Raft log entries as possible.
+// Operations are split into entries by count and size, each entry is applied atomically.
+// If atomic is true, all operations must fit into one entry and none of them is applied if any fails,
+// otherwise every operation succeeds or fails on its own.
+// Entries are sent without waiting for the previous ones to be committed
+func (s *RStorage) Bulk(ops []BulkOp, atomic bool) ([]BulkResult, error) {
+	if s.RaftNode.State() != raft.Leader {
+		return nil, ErrNotLeader
+	}
+
+	now := time.Now().UnixNano()
+	events := make([]*logEvent, len(ops))
+	for i, op := range ops {
+		events[i] = &logEvent{Type: op.Type, Key: op.Key, Data: op.Value, TTL: op.TTL, Lease: op.Lease, Time: now}
+	}
+	chunks := splitBulk(events, atomic)
+	if atomic && len(chunks) > 1 {
+		return nil, ErrBulkTooLarge
+	}
+
+	futures := make([]raft.ApplyFuture, len(chunks))
+	for i, chunk := range chunks {
+		data, err := encodeLogEvent(&logEvent{Type: "batch", Batch: chunk, Atomic: atomic, Time: now})
+		if err != nil {
+			return nil, err
+		}
+		futures[i] = s.RaftNode.Apply(data, applyTimeout)
+	}
+
+	results := make([]BulkResult, 0, len(ops))
+	for i, future := range futures {
+		chunkResults := make([]BulkResult, len(chunks[i]))
+		if err := future.Error(); err != nil {
+			for j := range chunkResults {
+				chunkResults[j].Err = translateRaftError(err)
+			}
+			results = append(results, chunkResults...)
+			continue
+		}
+
+		responses, ok := future.Response().([]interface{})
+		for j := range chunkResults {
+			if !ok || len(responses) != len(chunkResults) {
+				// the whole entry failed, e.g. it couldn't be decoded
+				chunkResults[j].Err = &FSMError{Err: fmt.Errorf("Unexpected FSM response: %+v", future.Response())}
+				continue
+			}
+			chunkResults[j] = newBulkResult(responses[j])
+		}
+		results = append(results, chunkResults...)
+	}
+	return results, nil
+}
+
+// newBulkResult converts the FSM response of a "set" or "delete" event to BulkResult
+func newBulkResult(response interface{}) BulkResult {
+	switch response := response.(type) {
+	case uint64:
+		return BulkResult{Index: response}
+	case deleteResult:
+		return BulkResult{Index: response.Index, Deleted: response.Deleted}
+	case error:
+		if response == ErrLeaseNotFound || response == ErrBulkAborted {
+			return BulkResult{Err: response}
+		}
+		return BulkResult{Err: &FSMError{Err: response}}
+	}
+	return BulkResult{Err: &FSMError{Err: fmt.Errorf("Unexpected FSM response: %+v", response)}}
+}
+
+// splitBulk splits events of a bulk write into Raft log entries limited by
+// maxBulkEntryOps and maxBatchBytes, a key is written only once in an entry.
+// Atomic writes are never split, so the caller has to check the number of entries
+func splitBulk(events []*logEvent, atomic bool) [][]*logEvent {
+	var chunks [][]*logEvent
+	var chunk []*logEvent
+	var keys map[string]bool
+	var size int
+	for _, event := range events {
+		eventSize := len(event.Key) + len(event.Data)
+		full := len(chunk) == maxBulkEntryOps || size+eventSize > maxBatchBytes
+		if len(chunk) > 0 && (full || (!atomic && keys[event.Key])) {
+			chunks = append(chunks, chunk)
+			chunk = nil
+		}
+		if len(chunk) == 0 {
+			keys = map[string]bool{}
+			size = 0
+		}
+		chunk = append(chunk, event)
+		keys[event.Key] = true
+		size += eventSize
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// checkAtomicBatch checks that all events of an atomic batch can be applied at the time now,
+// otherwise it returns the results of the aborted batch, s.mutex must be held
+func (s *RStorage) checkAtomicBatch(events []*logEvent, now int64) ([]interface{}, bool) {
+	results := make([]interface{}, len(events))
+	failed := false
+	for i, event := range events {
+		if event.Lease != 0 && !s.leaseAlive(event.Lease, now) {
+			results[i] = ErrLeaseNotFound
+			failed = true
+		} else {
+			results[i] = ErrBulkAborted
+		}
+	}
+	return results, !failed
+}
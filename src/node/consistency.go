@@ -0,0 +1,90 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Consistency is a consistency mode of reads
+type Consistency string
+
+const (
+	// ConsistencyStale reads are served by any node from its local state,
+	// they can return arbitrarily stale data if the node is partitioned
+	ConsistencyStale Consistency = "stale"
+	// ConsistencyLease reads are served by the leader, or by a follower which heard from the leader
+	// not longer than maxLeaseStaleness ago. The leader relies on its lease:
+	// it steps down if it can't contact the quorum during the LeaderLeaseTimeout
+	ConsistencyLease Consistency = "lease"
+	// ConsistencyLinearizable reads are served only by the leader after it confirms its leadership
+	// and applies all preceding log entries
+	ConsistencyLinearizable Consistency = "linearizable"
+)
+
+// maxLeaseStaleness is how long a follower can serve "lease" reads after the last contact with the leader
+const maxLeaseStaleness = 500 * time.Millisecond
+
+// ErrStaleRead is returned when a follower lost contact with the leader and can't serve a "lease" read
+var ErrStaleRead = errors.New("Node lost contact with the leader, can't serve the read")
+
+// ParseConsistency parses consistency mode from a string, empty string means "stale"
+func ParseConsistency(value string) (Consistency, error) {
+	switch Consistency(value) {
+	case "", ConsistencyStale:
+		return ConsistencyStale, nil
+	case ConsistencyLease, ConsistencyLinearizable:
+		return Consistency(value), nil
+	}
+	return "", fmt.Errorf("Unknown consistency mode: %s", value)
+}
+
+// CanServeRead reports whether this node can serve a read with given consistency
+// or it must be sent to the leader
+func (s *RStorage) CanServeRead(consistency Consistency) bool {
+	switch consistency {
+	case ConsistencyStale:
+		return true
+	case ConsistencyLease:
+		return s.RaftNode.State() == raft.Leader || s.LastContact() <= maxLeaseStaleness
+	}
+	return s.RaftNode.State() == raft.Leader
+}
+
+// VerifyRead must be called before reading the local state,
+// it blocks until the read can be served with given consistency
+func (s *RStorage) VerifyRead(consistency Consistency) error {
+	switch consistency {
+	case ConsistencyStale:
+		return nil
+	case ConsistencyLease:
+		if !s.CanServeRead(consistency) {
+			return ErrStaleRead
+		}
+		return nil
+	}
+
+	if s.RaftNode.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	// check that nobody else became a leader
+	if err := s.RaftNode.VerifyLeader().Error(); err != nil {
+		return translateRaftError(err)
+	}
+	// wait until all entries committed before the read are applied to the FSM
+	if err := s.RaftNode.Barrier(applyTimeout).Error(); err != nil {
+		return translateRaftError(err)
+	}
+	return nil
+}
+
+// LastContact returns time since the last contact with the leader, 0 on the leader itself
+// If the node never heard from a leader, the maximum duration is returned
+func (s *RStorage) LastContact() time.Duration {
+	if s.RaftNode.State() == raft.Leader {
+		return 0
+	}
+	return time.Since(s.RaftNode.LastContact())
+}
@@ -0,0 +1,95 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// counterKeyPrefix is the prefix of keys which hold counters, counters can be read and watched as usual keys
+const counterKeyPrefix = "_counters/"
+
+var (
+	// ErrCounterOverflow is returned when the counter can't be incremented without an overflow
+	ErrCounterOverflow = errors.New("Counter overflow")
+	// ErrNotCounter is returned when the counter key contains something else than an integer
+	ErrNotCounter = errors.New("Counter key doesn't contain an integer")
+	// ErrInvalidDelta is returned when the counter is incremented by zero or a negative number,
+	// counters only grow, so every increment returns a new unique value
+	ErrInvalidDelta = errors.New("Counter can be incremented only by a positive number")
+)
+
+// counterResult is returned by Apply for "incr" events
+type counterResult struct {
+	// Value is the value of the counter after the increment
+	Value int64
+	Index uint64
+}
+
+// counterKey returns the key which holds the counter
+func counterKey(name string) string {
+	return counterKeyPrefix + name
+}
+
+// Increment adds by to the counter and returns the new value,
+// a missing counter starts from 0, by must be positive
+func (s *RStorage) Increment(name string, by int64) (int64, uint64, error) {
+	if by <= 0 {
+		return 0, 0, ErrInvalidDelta
+	}
+	response, err := s.applyEvent(&logEvent{Type: "incr", Key: counterKey(name), Delta: by})
+	if err != nil {
+		return 0, 0, err
+	}
+	result, ok := response.(counterResult)
+	if !ok {
+		return 0, 0, fmt.Errorf("Unexpected FSM response: %+v", response)
+	}
+	return result.Value, result.Index, nil
+}
+
+// ReserveRange increments the counter by count in one Raft log entry
+// and returns the reserved range of values [start, end]
+func (s *RStorage) ReserveRange(name string, count int64) (int64, int64, uint64, error) {
+	if count <= 0 {
+		return 0, 0, 0, fmt.Errorf("Range size must be positive, got: %d", count)
+	}
+	end, index, err := s.Increment(name, count)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return end - count + 1, end, index, nil
+}
+
+// GetCounter returns the current value of the counter, 0 if it doesn't exist
+func (s *RStorage) GetCounter(name string) (int64, error) {
+	kv, exists := s.GetKeyValue(counterKey(name))
+	if !exists {
+		return 0, nil
+	}
+	value, err := strconv.ParseInt(string(kv.Value), 10, 64)
+	if err != nil {
+		return 0, ErrNotCounter
+	}
+	return value, nil
+}
+
+// applyIncrement is called by Apply for "incr" events, s.mutex must be held
+func (s *RStorage) applyIncrement(index uint64, now int64, key string, by int64) interface{} {
+	var value int64
+	if kv, exists := s.getKey(key, now); exists {
+		var err error
+		value, err = strconv.ParseInt(string(kv.Value), 10, 64)
+		if err != nil {
+			return ErrNotCounter
+		}
+	}
+
+	if (by > 0 && value > math.MaxInt64-by) || (by < 0 && value < math.MinInt64-by) {
+		return ErrCounterOverflow
+	}
+	value += by
+	s.putKey(key, KeyValue{Value: []byte(strconv.FormatInt(value, 10)), ModifyIndex: index})
+	return counterResult{Value: value, Index: index}
+}
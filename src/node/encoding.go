@@ -0,0 +1,56 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// Raft log entry format:
+//
+//	format     byte     encoding of the command, see logFormat* constants
+//	command    []byte   encoded logEvent
+//
+// Entries written before the format byte was added are plain JSON objects,
+// they always start with '{', so the first byte tells them apart.
+
+const (
+	// logFormatMsgpack is a msgpack encoded logEvent
+	logFormatMsgpack byte = 1
+	// logFormatLegacyJSON is the first byte of a JSON encoded logEvent
+	logFormatLegacyJSON byte = '{'
+)
+
+// encodeLogEvent encodes event for the Raft log
+func encodeLogEvent(event *logEvent) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(logFormatMsgpack)
+	if err := codec.NewEncoder(buf, &codec.MsgpackHandle{}).Encode(event); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeLogEvent decodes an event written by encodeLogEvent or a legacy JSON event
+func decodeLogEvent(data []byte) (*logEvent, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("Empty Raft log entry")
+	}
+
+	var event logEvent
+	switch data[0] {
+	case logFormatMsgpack:
+		if err := codec.NewDecoderBytes(data[1:], &codec.MsgpackHandle{}).Decode(&event); err != nil {
+			return nil, err
+		}
+	case logFormatLegacyJSON:
+		if err := json.Unmarshal(data, &event); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown Raft log entry format: %d", data[0])
+	}
+	return &event, nil
+}
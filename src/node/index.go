@@ -0,0 +1,51 @@
+package node
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrIndexTimeout is returned by WaitForIndex when the index wasn't applied in time
+var ErrIndexTimeout = errors.New("Timed out waiting for the index to be applied")
+
+// setAppliedIndex updates the last applied index and wakes up everybody who waits for it
+// s.mutex must be held
+func (s *RStorage) setAppliedIndex(index uint64) {
+	if index <= s.appliedIndex {
+		return
+	}
+	s.appliedIndex = index
+	close(s.appliedCh)
+	s.appliedCh = make(chan struct{})
+}
+
+// AppliedIndex returns the index of the last Raft log entry applied to the storage.
+// Unlike raft.AppliedIndex it is updated only after the entry is applied,
+// so all writes up to this index are visible for reads
+func (s *RStorage) AppliedIndex() uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.appliedIndex
+}
+
+// WaitForIndex blocks until the log entry with given index is applied to the storage
+func (s *RStorage) WaitForIndex(index uint64, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.mutex.RLock()
+		applied, appliedCh := s.appliedIndex, s.appliedCh
+		s.mutex.RUnlock()
+
+		if applied >= index {
+			return nil
+		}
+
+		select {
+		case <-appliedCh:
+		case <-timer.C:
+			return ErrIndexTimeout
+		}
+	}
+}
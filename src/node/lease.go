@@ -0,0 +1,199 @@
+package node
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrLeaseNotFound is returned when the lease doesn't exist or is already expired
+var ErrLeaseNotFound = errors.New("Lease not found")
+
+// Lease is a client session with a TTL, keys attached to the lease are deleted
+// when it is revoked or expires. The lease is kept alive by the client
+type Lease struct {
+	// ID is the index of the Raft log entry which granted the lease
+	ID  uint64
+	TTL time.Duration
+	// ExpiresAt is the time when the lease expires in Unix nanoseconds
+	ExpiresAt int64
+}
+
+// expired reports whether the lease is expired at the time now (Unix nanoseconds)
+func (l Lease) expired(now int64) bool {
+	return l.ExpiresAt <= now
+}
+
+// leaseResult is returned by Apply for lease events
+type leaseResult struct {
+	// Lease is the state of the lease after the event
+	Lease Lease
+	// Deleted is the number of keys deleted with the lease
+	Deleted int
+	Index   uint64
+}
+
+// leaseIndexKey returns a key of the leases tree, big-endian ID keeps leases ordered
+func leaseIndexKey(id uint64) []byte {
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], id)
+	return key[:]
+}
+
+// leaseKeyIndexKey returns a key of the leaseKeys tree: lease ID followed by the key,
+// so keys of a lease can be found by the lease ID prefix
+func leaseKeyIndexKey(id uint64, key string) []byte {
+	return append(leaseIndexKey(id), key...)
+}
+
+// getLease returns the lease by ID including expired leases, s.mutex must be held
+func (s *RStorage) getLease(id uint64) (Lease, bool) {
+	value, exists := s.leases.Get(leaseIndexKey(id))
+	if !exists {
+		return Lease{}, false
+	}
+	return value.(Lease), true
+}
+
+// leaseAlive reports whether the lease exists and isn't expired at the time now, s.mutex must be held
+func (s *RStorage) leaseAlive(id uint64, now int64) bool {
+	lease, exists := s.getLease(id)
+	return exists && !lease.expired(now)
+}
+
+// attachLease adds the key to the leaseKeys index if it has a lease, s.mutex must be held
+func (s *RStorage) attachLease(key string, kv KeyValue) {
+	if kv.Lease != 0 {
+		s.leaseKeys, _, _ = s.leaseKeys.Insert(leaseKeyIndexKey(kv.Lease, key), nil)
+	}
+}
+
+// detachLease removes the key from the leaseKeys index, s.mutex must be held
+func (s *RStorage) detachLease(key string, kv KeyValue) {
+	if kv.Lease != 0 {
+		s.leaseKeys, _, _ = s.leaseKeys.Delete(leaseKeyIndexKey(kv.Lease, key))
+	}
+}
+
+// attachedKeys returns keys attached to the lease, s.mutex must be held
+func (s *RStorage) attachedKeys(id uint64) []string {
+	keys := []string{}
+	s.leaseKeys.Root().WalkPrefix(leaseIndexKey(id), func(indexKey []byte, _ interface{}) bool {
+		keys = append(keys, string(indexKey[8:]))
+		return false
+	})
+	return keys
+}
+
+// GrantLease creates a new lease which expires after ttl unless it is kept alive
+func (s *RStorage) GrantLease(ttl time.Duration) (Lease, uint64, error) {
+	if ttl <= 0 {
+		return Lease{}, 0, fmt.Errorf("Lease TTL must be positive, got: %s", ttl)
+	}
+	return s.applyLeaseEvent(&logEvent{Type: "lease_grant", TTL: ttl})
+}
+
+// KeepAliveLease renews the lease, it expires after its TTL from now
+func (s *RStorage) KeepAliveLease(id uint64) (Lease, uint64, error) {
+	return s.applyLeaseEvent(&logEvent{Type: "lease_keepalive", Lease: id})
+}
+
+// RevokeLease deletes the lease and all keys attached to it in one Raft log entry
+// returns the number of deleted keys and the Raft log index of the write
+func (s *RStorage) RevokeLease(id uint64) (int, uint64, error) {
+	response, err := s.applyEvent(&logEvent{Type: "lease_revoke", Lease: id})
+	if err != nil {
+		return 0, 0, err
+	}
+	result, ok := response.(leaseResult)
+	if !ok {
+		return 0, 0, fmt.Errorf("Unexpected FSM response: %+v", response)
+	}
+	return result.Deleted, result.Index, nil
+}
+
+// GetLease returns the lease with keys attached to it
+// the second returned value is false if the lease doesn't exist or is expired
+func (s *RStorage) GetLease(id uint64) (Lease, []string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	lease, exists := s.getLease(id)
+	if !exists || lease.expired(time.Now().UnixNano()) {
+		return Lease{}, nil, false
+	}
+	return lease, s.attachedKeys(id), true
+}
+
+// applyLeaseEvent replicates the lease event and returns the lease and the Raft log index of the write
+func (s *RStorage) applyLeaseEvent(event *logEvent) (Lease, uint64, error) {
+	response, err := s.applyEvent(event)
+	if err != nil {
+		return Lease{}, 0, err
+	}
+	result, ok := response.(leaseResult)
+	if !ok {
+		return Lease{}, 0, fmt.Errorf("Unexpected FSM response: %+v", response)
+	}
+	return result.Lease, result.Index, nil
+}
+
+// applyLeaseGrant is called by Apply for "lease_grant" events, s.mutex must be held
+func (s *RStorage) applyLeaseGrant(index uint64, now int64, ttl time.Duration) leaseResult {
+	lease := Lease{ID: index, TTL: ttl, ExpiresAt: now + int64(ttl)}
+	s.leases, _, _ = s.leases.Insert(leaseIndexKey(lease.ID), lease)
+	return leaseResult{Lease: lease, Index: index}
+}
+
+// applyLeaseKeepAlive is called by Apply for "lease_keepalive" events, s.mutex must be held.
+// An expired lease can't be renewed even if the leader hasn't revoked it yet
+func (s *RStorage) applyLeaseKeepAlive(index uint64, now int64, id uint64) interface{} {
+	lease, exists := s.getLease(id)
+	if !exists || lease.expired(now) {
+		return ErrLeaseNotFound
+	}
+	lease.ExpiresAt = now + int64(lease.TTL)
+	s.leases, _, _ = s.leases.Insert(leaseIndexKey(id), lease)
+	return leaseResult{Lease: lease, Index: index}
+}
+
+// applyLeaseRevoke is called by Apply for "lease_revoke" events, s.mutex must be held
+func (s *RStorage) applyLeaseRevoke(index uint64, id uint64) interface{} {
+	if _, exists := s.getLease(id); !exists {
+		return ErrLeaseNotFound
+	}
+
+	result := leaseResult{Index: index}
+	for _, key := range s.attachedKeys(id) {
+		s.deleteKey(key, index)
+		result.Deleted++
+	}
+	s.leases, _, _ = s.leases.Delete(leaseIndexKey(id))
+	return result
+}
+
+// applyLeaseExpire is called by Apply for "lease_expire" events, s.mutex must be held.
+// The leader may find the lease expired right before a keepalive is applied,
+// so the expiry time is checked again with the time of the event
+func (s *RStorage) applyLeaseExpire(index uint64, now int64, id uint64) interface{} {
+	if lease, exists := s.getLease(id); exists && !lease.expired(now) {
+		return leaseResult{Lease: lease, Index: index}
+	}
+	return s.applyLeaseRevoke(index, id)
+}
+
+// expiredLeases returns IDs of leases expired at the time now
+func (s *RStorage) expiredLeases(now int64) []uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var ids []uint64
+	s.leases.Root().Walk(func(_ []byte, value interface{}) bool {
+		if lease := value.(Lease); lease.expired(now) {
+			ids = append(ids, lease.ID)
+		}
+		return false
+	})
+	return ids
+}
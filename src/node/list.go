@@ -0,0 +1,58 @@
+package node
+
+import (
+	"time"
+)
+
+// ListOptions filters keys returned by List
+type ListOptions struct {
+	// Prefix returns only keys which start with the prefix
+	Prefix string
+	// Start is the first key of the range, inclusive
+	Start string
+	// End is the end of the range, exclusive, empty means no limit
+	End string
+	// Limit is the maximum number of returned keys, 0 means no limit
+	Limit int
+}
+
+// KeyValuePair is a key with its value returned by List
+type KeyValuePair struct {
+	Key string
+	KeyValue
+}
+
+// List returns keys matching opts in lexicographical order.
+// If there are more keys than opts.Limit, the second returned value is the next key,
+// it can be used as opts.Start to continue listing
+func (s *RStorage) List(opts ListOptions) ([]KeyValuePair, string) {
+	s.mutex.RLock()
+	storage, leases := s.storage, s.leases
+	s.mutex.RUnlock()
+
+	// the trees are immutable, so we can walk them without holding the lock
+	now := time.Now().UnixNano()
+	result := []KeyValuePair{}
+	next := ""
+	storage.Root().WalkPrefix([]byte(opts.Prefix), func(k []byte, value interface{}) bool {
+		key := string(k)
+		if key < opts.Start {
+			return false
+		}
+		if opts.End != "" && key >= opts.End {
+			return true
+		}
+		kv := value.(KeyValue)
+		if keyExpired(kv, leases, now) {
+			return false
+		}
+		if opts.Limit > 0 && len(result) == opts.Limit {
+			next = key
+			return true
+		}
+		result = append(result, KeyValuePair{Key: key, KeyValue: kv})
+		return false
+	})
+
+	return result, next
+}
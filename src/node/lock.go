@@ -0,0 +1,117 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// lockKeyPrefix is the prefix of keys which hold locks, locks can be listed and watched as usual keys
+const lockKeyPrefix = "_locks/"
+
+var (
+	// ErrLockHeld is returned when the lock is held by another lease
+	ErrLockHeld = errors.New("Lock is held by another session")
+	// ErrLockNotHeld is returned by ReleaseLock when the lock isn't held with the token
+	ErrLockNotHeld = errors.New("Lock is not held with this token")
+)
+
+// LockHolder describes who holds a lock
+type LockHolder struct {
+	Owner string
+	Lease uint64
+	// Token is the Raft log index of the write which acquired the lock, it increases with every acquisition,
+	// so downstream systems can reject requests with tokens older than the last seen one
+	Token uint64
+}
+
+// lockHolderLookup reads the holder after a failed acquisition, tests replace it to change the lock in between
+var lockHolderLookup = (*RStorage).GetLockHolder
+
+// lockKey returns the key which holds the lock
+func lockKey(name string) string {
+	return lockKeyPrefix + name
+}
+
+// AcquireLock acquires the lock for the lease, the lock is released when the lease is revoked or expires.
+// If the lock is held by another lease, it waits for the lock until wait expires or cancel is closed.
+// Acquiring a lock already held by the same lease returns the current holder
+func (s *RStorage) AcquireLock(name string, lease uint64, owner string, cancel <-chan struct{}, wait time.Duration) (LockHolder, error) {
+	if lease == 0 {
+		return LockHolder{}, fmt.Errorf("Lock requires a lease")
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		holder, err := s.tryAcquireLock(name, lease, owner)
+		if err != ErrLockHeld {
+			return holder, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return holder, ErrLockHeld
+		}
+		s.WaitForKeyChange(lockKey(name), holder.Token, cancel, remaining)
+		select {
+		case <-cancel:
+			return holder, ErrLockHeld
+		default:
+		}
+	}
+}
+
+// tryAcquireLock creates the lock key if it doesn't exist
+// returns the current holder and ErrLockHeld if the lock is held by another lease
+func (s *RStorage) tryAcquireLock(name string, lease uint64, owner string) (LockHolder, error) {
+	for {
+		token, err := s.CompareAndSet(lockKey(name), []byte(owner), 0, SetOptions{Lease: lease})
+		if err == nil {
+			return LockHolder{Owner: owner, Lease: lease, Token: token}, nil
+		}
+		if err != ErrKeyExists {
+			return LockHolder{}, err
+		}
+
+		// this node is the leader, so the lock key is up to date
+		holder, exists := lockHolderLookup(s, name)
+		if !exists {
+			// the lock is released or its lease expired right after the write, so it is free now.
+			// Waiting for a change of the missing key would never wake up, try again instead
+			continue
+		}
+		if holder.Lease == lease {
+			return holder, nil
+		}
+		return holder, ErrLockHeld
+	}
+}
+
+// ReleaseLock releases the lock if it is still held with the token
+func (s *RStorage) ReleaseLock(name string, token uint64) (uint64, error) {
+	if token == 0 {
+		return 0, ErrLockNotHeld
+	}
+	key := lockKey(name)
+	result, err := s.Txn(&TxnRequest{
+		Compare: []TxnCompare{{Key: key, Target: "revision", Revision: token}},
+		Success: []TxnOp{{Type: "delete", Key: key}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !result.Succeeded {
+		return result.Index, ErrLockNotHeld
+	}
+	return result.Index, nil
+}
+
+// GetLockHolder returns the current holder of the lock
+// the second returned value is false if the lock is free
+func (s *RStorage) GetLockHolder(name string) (LockHolder, bool) {
+	kv, exists := s.GetKeyValue(lockKey(name))
+	if !exists {
+		return LockHolder{}, false
+	}
+	return LockHolder{Owner: string(kv.Value), Lease: kv.Lease, Token: kv.ModifyIndex}, true
+}
@@ -3,42 +3,73 @@ package node
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/hashicorp/go-immutable-radix"
 	"github.com/hashicorp/raft"
 	rbolt "github.com/hashicorp/raft-boltdb"
 )
 
 // Config struct handles configuration for a node
 type Config struct {
-	BindAddress    string
+	BindAddress string
+	// NodeIdentifier is the Raft server ID of the node, it is stored in DataDir on the first start,
+	// see loadNodeID
 	NodeIdentifier string
 	JoinAddress    string
 	DataDir        string
 	Bootstrap      bool
+	// MaxBatchSize is the maximum number of writes grouped into one Raft log entry,
+	// batching is disabled if it is less than 2
+	MaxBatchSize int
+	// BatchLinger is how long a batch waits for more writes before it is sent
+	BatchLinger time.Duration
+	// MinVoters is the minimum number of voters, removals of servers are refused below it
+	MinVoters int
+	// Nonvoter makes the node join the cluster as a non-voter
+	Nonvoter bool
+	// HTTPAdvertiseAddress is the HTTP address of the node, it is registered in the FSM,
+	// so other nodes can forward requests to it, see RegisterNode
+	HTTPAdvertiseAddress string
 }
 
 // NewRStorage initiates a new RStorage node
 func NewRStorage(config *Config) (*RStorage, error) {
 	rstorage := RStorage{
-		storage: map[string]string{},
-		config:  *config,
+		storage:    iradix.New(),
+		expiries:   iradix.New(),
+		leases:     iradix.New(),
+		leaseKeys:  iradix.New(),
+		nodes:      iradix.New(),
+		config:     *config,
+		appliedCh:  make(chan struct{}),
+		history:    newEventHistory(watchHistorySize),
+		keyWaiters: map[string]*keyWaiter{},
 	}
 
 	if err := os.MkdirAll(config.DataDir, 0700); err != nil {
 		return nil, err
 	}
+	id, err := loadNodeID(config)
+	if err != nil {
+		return nil, err
+	}
+	rstorage.config.NodeIdentifier = id
+	log.Printf("[INFO] Node ID is %s", id)
 
 	logger := log.New(os.Stdout, "[raft]", 0)
 
 	raftConfig := raft.DefaultConfig()
-	raftConfig.LocalID = raft.ServerID(config.NodeIdentifier)
+	raftConfig.LocalID = raft.ServerID(id)
 	raftConfig.Logger = logger
 	transport, err := raftTransport(config.BindAddress)
 	if err != nil {
@@ -50,7 +81,7 @@ func NewRStorage(config *Config) (*RStorage, error) {
 		return nil, err
 	}
 
-	logStore, err := rbolt.NewBoltStore(filepath.Join(config.DataDir, "raft-log.bolt"))
+	logStore, err := rbolt.NewBoltStore(filepath.Join(config.DataDir, raftLogFile))
 	if err != nil {
 		return nil, err
 	}
@@ -85,10 +116,64 @@ func NewRStorage(config *Config) (*RStorage, error) {
 	}
 
 	rstorage.RaftNode = raftNode
+	// background goroutines write through applyEvent, which reads batchCh,
+	// so it must be set before any of them starts
+	if config.MaxBatchSize > 1 {
+		rstorage.batchCh = make(chan *pendingEvent)
+		go rstorage.runBatcher()
+	}
+	go rstorage.runExpiry()
+	if config.HTTPAdvertiseAddress != "" {
+		go rstorage.runRegistration()
+	}
 
 	return &rstorage, nil
 }
 
+// nodeIDFile is the file in the data dir which keeps ID of the node,
+// so the node stays the same cluster member when its address changes
+const nodeIDFile = "node-id"
+
+// raftLogFile is the file in the data dir which keeps the Raft log
+const raftLogFile = "raft-log.bolt"
+
+// loadNodeID returns ID of the node stored in the data dir.
+// On the first start the configured ID is stored, or the bind address if there is no ID,
+// later the configured ID must be either empty or the same.
+// Data dirs created before IDs were stored use the bind address as the ID in their Raft configuration,
+// so the bind address is stored for them
+func loadNodeID(config *Config) (string, error) {
+	path := filepath.Join(config.DataDir, nodeIDFile)
+	stored, err := ioutil.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(stored))
+		if config.NodeIdentifier != "" && config.NodeIdentifier != id {
+			return "", fmt.Errorf("Data dir %s belongs to node %s, but the node ID is %s", config.DataDir, id, config.NodeIdentifier)
+		}
+		return id, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	id := config.NodeIdentifier
+	if _, err := os.Stat(filepath.Join(config.DataDir, raftLogFile)); err == nil {
+		if id != "" && id != config.BindAddress {
+			return "", fmt.Errorf("Data dir %s has Raft state of node %s without a stored ID, the node ID can't be changed to %s", config.DataDir, config.BindAddress, id)
+		}
+		id = config.BindAddress
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if id == "" {
+		id = config.BindAddress
+	}
+	if err := ioutil.WriteFile(path, []byte(id+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
 func raftTransport(bindAddr string) (*raft.NetworkTransport, error) {
 	address, err := net.ResolveTCPAddr("tcp", bindAddr)
 	if err != nil {
@@ -104,6 +189,11 @@ func raftTransport(bindAddr string) (*raft.NetworkTransport, error) {
 	return transport, nil
 }
 
+// NodeID returns Raft server ID of this node
+func (s *RStorage) NodeID() string {
+	return s.config.NodeIdentifier
+}
+
 // GetClusterServers returns all cluster's servers
 func (s *RStorage) GetClusterServers() ([]raft.Server, error) {
 	confugurationFuture := s.RaftNode.GetConfiguration()
@@ -116,28 +206,252 @@ func (s *RStorage) GetClusterServers() ([]raft.Server, error) {
 }
 
 // AddVoter joins a new voter to a cluster
-// must be called only on a leader
-func (s *RStorage) AddVoter(address string) error {
-	log.Printf("[INFO] trying to add new voter at [%s] to the cluster", address)
-	addFuture := s.RaftNode.AddVoter(raft.ServerID(address), raft.ServerAddress(address), 0, 0)
+// must be called only on a leader.
+// If the node with the ID is already in the cluster with another address, its address is updated,
+// a server of another node with the same address is removed from the cluster
+func (s *RStorage) AddVoter(id string, address string) error {
+	return s.addServer(id, address, raft.Voter)
+}
+
+// AddNonvoter joins a new non-voter to a cluster, it receives the log, but doesn't vote
+// and doesn't affect the commit latency, see AddVoter and PromoteNonvoter
+func (s *RStorage) AddNonvoter(id string, address string) error {
+	return s.addServer(id, address, raft.Nonvoter)
+}
+
+// addServer adds a server to the cluster, see AddVoter.
+// The role of a server which is already in the cluster with the same address isn't changed,
+// a server with a new address is added again. Returns ErrAddressInUse if another server has the address
+func (s *RStorage) addServer(id string, address string, suffrage raft.ServerSuffrage) error {
+	log.Printf("[INFO] trying to add new %s %s at [%s] to the cluster", suffrage, id, address)
+	configurationFuture := s.RaftNode.GetConfiguration()
+	if err := configurationFuture.Error(); err != nil {
+		return translateRaftError(err)
+	}
+
+	// every change must be applied right after the previous one,
+	// otherwise Raft rejects it and the node has to join again
+	prevIndex := configurationFuture.Index()
+	var oldAddress raft.ServerAddress
+	for _, server := range configurationFuture.Configuration().Servers {
+		sameID := server.ID == raft.ServerID(id)
+		sameAddress := server.Address == raft.ServerAddress(address)
+		switch {
+		case sameID && sameAddress:
+			log.Printf("[INFO] %s at [%s] is already in the cluster as %s", id, address, server.Suffrage)
+			return nil
+		case sameID:
+			oldAddress = server.Address
+		case sameAddress:
+			// the other server must be removed explicitly, so it isn't dropped by a misconfigured node
+			log.Printf("[ERROR] [%s] belongs to %s, can't add %s", address, server.ID, id)
+			return ErrAddressInUse
+		}
+	}
+
+	if oldAddress != "" {
+		// Raft can update the address in place, but then the leader keeps replicating
+		// to the old address until the next election, so the server is added again
+		log.Printf("[INFO] %s moved from [%s] to [%s]", id, oldAddress, address)
+		removeFuture := s.RaftNode.RemoveServer(raft.ServerID(id), prevIndex, 0)
+		if err := removeFuture.Error(); err != nil {
+			log.Printf("[ERROR] cant remove %s from the cluster: %v", id, err)
+			return translateRaftError(err)
+		}
+		prevIndex = removeFuture.Index()
+	}
+
+	var addFuture raft.IndexFuture
+	if suffrage == raft.Nonvoter {
+		addFuture = s.RaftNode.AddNonvoter(raft.ServerID(id), raft.ServerAddress(address), prevIndex, 0)
+	} else {
+		addFuture = s.RaftNode.AddVoter(raft.ServerID(id), raft.ServerAddress(address), prevIndex, 0)
+	}
 	if err := addFuture.Error(); err != nil {
 		log.Printf("[ERROR] cant join to the cluster: %v", err)
-		return err
+		return translateRaftError(err)
+	}
+	return nil
+}
+
+var (
+	// ErrServerNotFound is returned when a server with the ID is not in the cluster
+	ErrServerNotFound = errors.New("Server is not in the cluster")
+	// ErrMinVoters is returned when a removal or demotion would leave the cluster
+	// with less than Config.MinVoters voters
+	ErrMinVoters = errors.New("Cluster can't have less voters than the configured minimum")
+	// ErrCatchUpTimeout is returned when a non-voter doesn't catch up with the leader in time to be promoted
+	ErrCatchUpTimeout = errors.New("Non-voter didn't catch up with the leader in time")
+	// ErrAddressInUse is returned when a server joins with the address of another server of the cluster
+	ErrAddressInUse = errors.New("Address belongs to another server of the cluster, remove it first")
+)
+
+// promotionPollInterval is how often PromoteNonvoter checks the applied index of a non-voter
+const promotionPollInterval = time.Millisecond * 200
+
+// RemoveServer removes the server with the ID from the cluster, must be called only on a leader.
+// The leader can remove itself too, it steps down after the removal is committed.
+// Returns the Raft log index of the configuration change
+func (s *RStorage) RemoveServer(id string) (uint64, error) {
+	log.Printf("[INFO] trying to remove %s from the cluster", id)
+	server, prevIndex, err := s.getServerForChange(id)
+	if err != nil {
+		return 0, err
+	}
+	if server.Suffrage == raft.Voter {
+		if err := s.checkMinVoters(); err != nil {
+			return 0, err
+		}
+	}
+
+	// the removal fails if the configuration was changed after the check
+	removeFuture := s.RaftNode.RemoveServer(raft.ServerID(id), prevIndex, 0)
+	if err := removeFuture.Error(); err != nil {
+		log.Printf("[ERROR] cant remove %s from the cluster: %v", id, err)
+		return 0, translateRaftError(err)
+	}
+
+	// a leader which removed itself isn't the leader anymore, the next join registers the address again
+	if _, exists := s.NodeHTTPAddress(id); exists {
+		if _, err := s.DeregisterNode(id); err != nil {
+			log.Printf("[ERROR] Can't deregister HTTP address of %s: %+v", id, err)
+		}
+	}
+	return removeFuture.Index(), nil
+}
+
+// DemoteVoter makes a voter a non-voter, must be called only on a leader.
+// Returns the Raft log index of the configuration change
+func (s *RStorage) DemoteVoter(id string) (uint64, error) {
+	log.Printf("[INFO] trying to demote %s", id)
+	server, prevIndex, err := s.getServerForChange(id)
+	if err != nil {
+		return 0, err
+	}
+	if server.Suffrage != raft.Voter {
+		return prevIndex, nil
+	}
+	if err := s.checkMinVoters(); err != nil {
+		return 0, err
+	}
+
+	demoteFuture := s.RaftNode.DemoteVoter(raft.ServerID(id), prevIndex, 0)
+	if err := demoteFuture.Error(); err != nil {
+		log.Printf("[ERROR] cant demote %s: %v", id, err)
+		return 0, translateRaftError(err)
+	}
+	return demoteFuture.Index(), nil
+}
+
+// PromoteNonvoter makes a non-voter a voter when it catches up with the leader, must be called only on a leader.
+// appliedIndex returns the index of the last log entry applied on the non-voter, it is polled until
+// the non-voter is behind the leader by at most maxLag entries or until the timeout expires.
+// Returns the Raft log index of the configuration change
+func (s *RStorage) PromoteNonvoter(id string, maxLag uint64, appliedIndex func(raft.Server) (uint64, error), cancel <-chan struct{}, timeout time.Duration) (uint64, error) {
+	log.Printf("[INFO] trying to promote %s", id)
+	deadline := time.After(timeout)
+	for {
+		server, prevIndex, err := s.getServerForChange(id)
+		if err != nil {
+			return 0, err
+		}
+		if server.Suffrage == raft.Voter {
+			return prevIndex, nil
+		}
+
+		nonvoterIndex, err := appliedIndex(server)
+		if err != nil {
+			log.Printf("[ERROR] Can't get the applied index of %s: %+v", id, err)
+		} else if nonvoterIndex+maxLag >= s.AppliedIndex() {
+			addFuture := s.RaftNode.AddVoter(server.ID, server.Address, prevIndex, 0)
+			if err := addFuture.Error(); err != nil {
+				log.Printf("[ERROR] cant promote %s: %v", id, err)
+				return 0, translateRaftError(err)
+			}
+			return addFuture.Index(), nil
+		}
+
+		select {
+		case <-time.After(promotionPollInterval):
+		case <-deadline:
+			return 0, ErrCatchUpTimeout
+		case <-cancel:
+			return 0, ErrCatchUpTimeout
+		}
+	}
+}
+
+// getServerForChange returns the server with the ID and the index of the current configuration,
+// which must be used as prevIndex of the change, so the change fails if the configuration is changed meanwhile
+func (s *RStorage) getServerForChange(id string) (raft.Server, uint64, error) {
+	if s.RaftNode.State() != raft.Leader {
+		return raft.Server{}, 0, ErrNotLeader
+	}
+	configurationFuture := s.RaftNode.GetConfiguration()
+	if err := configurationFuture.Error(); err != nil {
+		return raft.Server{}, 0, translateRaftError(err)
+	}
+	for _, server := range configurationFuture.Configuration().Servers {
+		if server.ID == raft.ServerID(id) {
+			return server, configurationFuture.Index(), nil
+		}
+	}
+	return raft.Server{}, 0, ErrServerNotFound
+}
+
+// checkMinVoters returns ErrMinVoters if the cluster can't lose a voter
+func (s *RStorage) checkMinVoters() error {
+	servers, err := s.GetClusterServers()
+	if err != nil {
+		return translateRaftError(err)
+	}
+	voters := 0
+	for _, server := range servers {
+		if server.Suffrage == raft.Voter {
+			voters++
+		}
+	}
+	if voters-1 < s.minVoters() {
+		return ErrMinVoters
 	}
 	return nil
 }
 
+// minVoters returns the minimum number of voters, a cluster always keeps at least one
+func (s *RStorage) minVoters() int {
+	if s.config.MinVoters < 1 {
+		return 1
+	}
+	return s.config.MinVoters
+}
+
 // JoinCluster sends a POST request to "join" address
-// to ask the cluster leader join this node as a voter
+// to ask the cluster leader join this node as a voter or a non-voter
 func (s *RStorage) JoinCluster(leaderHTTPAddress string) error {
 	servers, err := s.GetClusterServers()
-	alreadyInCluster := (err == nil && len(servers) > 1)
-	if alreadyInCluster {
-		log.Printf("[INFO] Node already in the cluster, skipping /cluster/join/ POST request to the leader")
-		return nil
+	if err == nil && len(servers) > 1 {
+		// a node which is restarted with another address must join again to update it
+		registered, _ := s.NodeHTTPAddress(s.NodeID())
+		for _, server := range servers {
+			if server.ID == raft.ServerID(s.NodeID()) && server.Address == raft.ServerAddress(s.config.BindAddress) &&
+				registered == s.config.HTTPAdvertiseAddress {
+				log.Printf("[INFO] Node already in the cluster, skipping /cluster/join/ POST request to the leader")
+				return nil
+			}
+		}
 	}
 
-	body, err := json.Marshal(map[string]string{"address": s.config.BindAddress})
+	role := "voter"
+	if s.config.Nonvoter {
+		role = "nonvoter"
+	}
+	body, err := json.Marshal(map[string]string{
+		"id":      s.NodeID(),
+		"address": s.config.BindAddress,
+		"role":    role,
+		// the leader registers the HTTP address, so other nodes can forward requests to this node
+		"http_address": s.config.HTTPAdvertiseAddress,
+	})
 	if err != nil {
 		return err
 	}
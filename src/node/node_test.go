@@ -0,0 +1,138 @@
+package node
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadNodeID(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "node-id")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dataDir)
+
+	id, err := loadNodeID(&Config{DataDir: dataDir, BindAddress: "10.0.0.1:4000", NodeIdentifier: "node_1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "node_1", id)
+
+	id, err = loadNodeID(&Config{DataDir: dataDir, BindAddress: "10.0.0.2:4000"})
+	assert.Nil(t, err)
+	assert.Equal(t, "node_1", id, "Stored ID must be used when the address changes")
+
+	_, err = loadNodeID(&Config{DataDir: dataDir, BindAddress: "10.0.0.2:4000", NodeIdentifier: "node_2"})
+	assert.NotNil(t, err, "Data dir of another node must not be used")
+
+	os.Remove(filepath.Join(dataDir, nodeIDFile))
+	id, err = loadNodeID(&Config{DataDir: dataDir, BindAddress: "10.0.0.2:4000"})
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.2:4000", id, "Bind address is the default ID")
+
+	// the data dir is created before node IDs were stored
+	os.Remove(filepath.Join(dataDir, nodeIDFile))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dataDir, raftLogFile), nil, 0600))
+	_, err = loadNodeID(&Config{DataDir: dataDir, BindAddress: "10.0.0.2:4000", NodeIdentifier: "node_2"})
+	assert.NotNil(t, err, "Raft state of the node uses the bind address as the ID")
+	id, err = loadNodeID(&Config{DataDir: dataDir, BindAddress: "10.0.0.2:4000"})
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.2:4000", id)
+	id, err = loadNodeID(&Config{DataDir: dataDir, BindAddress: "10.0.0.3:4000"})
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.2:4000", id, "Bind address must be stored as the ID")
+}
+
+func TestNodeRegistration(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{})
+
+	assert.Equal(t, uint64(1), applyTestEvent(s, 1, &logEvent{Type: "node_register", Key: "node_1", Address: "10.0.0.1:8080"}))
+	assert.Equal(t, uint64(2), applyTestEvent(s, 2, &logEvent{Type: "node_register", Key: "node_2", Address: "10.0.0.2:8080"}))
+	assert.Equal(t, uint64(3), applyTestEvent(s, 3, &logEvent{Type: "node_register", Key: "node_2", Address: "10.0.0.2:9090"}))
+	assert.NotNil(t, applyTestEvent(s, 4, &logEvent{Type: "node_register", Key: "node_3"}), "Address is required")
+
+	address, exists := s.NodeHTTPAddress("node_2")
+	assert.True(t, exists)
+	assert.Equal(t, "10.0.0.2:9090", address, "Registration must update the address")
+	_, exists = s.NodeHTTPAddress("node_3")
+	assert.False(t, exists)
+	assert.Equal(t, 0, s.storage.Len(), "Nodes must not be visible as keys")
+
+	restored := newTestStorage(map[string]KeyValue{})
+	persistAndRestore(t, raft.NewInmemSnapshotStore(), s, restored)
+	address, exists = restored.NodeHTTPAddress("node_1")
+	assert.True(t, exists, "Nodes must be restored from a snapshot")
+	assert.Equal(t, "10.0.0.1:8080", address)
+
+	assert.Equal(t, uint64(5), applyTestEvent(restored, 5, &logEvent{Type: "node_deregister", Key: "node_1"}))
+	_, exists = restored.NodeHTTPAddress("node_1")
+	assert.False(t, exists)
+}
+
+func TestBatcherStopsOnShutdown(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "batcher")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dataDir)
+
+	s, err := NewRStorage(&Config{BindAddress: "127.0.0.1:6680", DataDir: dataDir, Bootstrap: true, MaxBatchSize: 64})
+	assert.Nil(t, err)
+	assert.NotNil(t, s.batchCh, "Batching must be enabled")
+	assert.Nil(t, s.RaftNode.Shutdown().Error())
+
+	stopped := make(chan struct{})
+	go func() {
+		s.runBatcher()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(batcherShutdownInterval * 3):
+		t.Fatal("Batcher must stop after Raft is shut down")
+	}
+}
+
+// startTestLeader starts a single node cluster and waits until the node becomes the leader
+func startTestLeader(t *testing.T, bindAddress string, dataDir string) *RStorage {
+	s, err := NewRStorage(&Config{BindAddress: bindAddress, DataDir: dataDir, Bootstrap: true})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	for startedAt := time.Now(); s.RaftNode.State() != raft.Leader; time.Sleep(time.Millisecond * 50) {
+		if time.Since(startedAt) > time.Second*10 {
+			t.Fatal("Node didn't become the leader")
+		}
+	}
+	return s
+}
+
+func TestAcquireLockReleasedAfterConflict(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "lock")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dataDir)
+	s := startTestLeader(t, "127.0.0.1:6681", dataDir)
+	defer s.RaftNode.Shutdown()
+
+	first, _, err := s.GrantLease(time.Millisecond * 500)
+	assert.Nil(t, err)
+	second, _, err := s.GrantLease(time.Minute)
+	assert.Nil(t, err)
+	_, err = s.AcquireLock("expiring", first.ID, "first", nil, 0)
+	assert.Nil(t, err)
+
+	// the lease of the holder expires after the write failed, but before the holder is read
+	defer func() { lockHolderLookup = (*RStorage).GetLockHolder }()
+	lookups := 0
+	lockHolderLookup = func(s *RStorage, name string) (LockHolder, bool) {
+		lookups++
+		time.Sleep(time.Until(time.Unix(0, first.ExpiresAt)) + time.Millisecond*10)
+		return s.GetLockHolder(name)
+	}
+
+	holder, err := s.AcquireLock("expiring", second.ID, "second", nil, 0)
+	assert.Nil(t, err, "Free lock must be acquired without waiting")
+	assert.Equal(t, "second", holder.Owner)
+	assert.Equal(t, second.ID, holder.Lease)
+	assert.Equal(t, 1, lookups, "The first write must fail while the lease is alive")
+}
@@ -0,0 +1,97 @@
+package node
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// registerInterval is how often the leader checks that its own HTTP address is registered
+const registerInterval = time.Second
+
+// RegisterNode stores the HTTP address of the node in the FSM,
+// so every node can find its HTTP endpoint by the node ID.
+// Must be called only on the leader
+func (s *RStorage) RegisterNode(id string, httpAddress string) (uint64, error) {
+	log.Printf("[INFO] Registering HTTP address %s of %s", httpAddress, id)
+	return s.applyNodeEvent(&logEvent{Type: "node_register", Key: id, Address: httpAddress})
+}
+
+// DeregisterNode removes the HTTP address of the node from the FSM
+func (s *RStorage) DeregisterNode(id string) (uint64, error) {
+	return s.applyNodeEvent(&logEvent{Type: "node_deregister", Key: id})
+}
+
+// applyNodeEvent replicates the node event and returns the Raft log index of the write
+func (s *RStorage) applyNodeEvent(event *logEvent) (uint64, error) {
+	response, err := s.applyEvent(event)
+	if err != nil {
+		return 0, err
+	}
+	index, ok := response.(uint64)
+	if !ok {
+		return 0, fmt.Errorf("Unexpected FSM response: %+v", response)
+	}
+	return index, nil
+}
+
+// NodeHTTPAddress returns the HTTP address registered by the node,
+// the second returned value is false if the node hasn't registered it
+func (s *RStorage) NodeHTTPAddress(id string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	value, exists := s.nodes.Get([]byte(id))
+	if !exists {
+		return "", false
+	}
+	return value.(string), true
+}
+
+// HTTPAdvertiseAddress returns the HTTP address other nodes and clients use to reach this node
+func (s *RStorage) HTTPAdvertiseAddress() string {
+	return s.config.HTTPAdvertiseAddress
+}
+
+// applyNodeRegister is called by Apply for "node_register" events, s.mutex must be held
+func (s *RStorage) applyNodeRegister(index uint64, id string, httpAddress string) interface{} {
+	if id == "" || httpAddress == "" {
+		return fmt.Errorf("node_register event without a node ID or an address")
+	}
+	s.nodes, _, _ = s.nodes.Insert([]byte(id), httpAddress)
+	return index
+}
+
+// applyNodeDeregister is called by Apply for "node_deregister" events, s.mutex must be held
+func (s *RStorage) applyNodeDeregister(index uint64, id string) interface{} {
+	s.nodes, _, _ = s.nodes.Delete([]byte(id))
+	return index
+}
+
+// runRegistration registers the HTTP address of the leader itself.
+// Other nodes register their addresses when they join the cluster,
+// but the node which bootstrapped the cluster never joins
+func (s *RStorage) runRegistration() {
+	ticker := time.NewTicker(registerInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		switch s.RaftNode.State() {
+		case raft.Shutdown:
+			return
+		case raft.Leader:
+		default:
+			continue
+		}
+
+		address := s.HTTPAdvertiseAddress()
+		if registered, _ := s.NodeHTTPAddress(s.NodeID()); registered == address {
+			continue
+		}
+		if _, err := s.RegisterNode(s.NodeID(), address); err != nil {
+			log.Printf("[ERROR] Can't register HTTP address of the leader: %+v", err)
+		}
+	}
+}
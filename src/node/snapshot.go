@@ -0,0 +1,300 @@
+package node
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/hashicorp/go-immutable-radix"
+)
+
+// Snapshot binary format:
+//
+//	header:
+//	    magic      [4]byte  "RKVS"
+//	    version    uint16   format version, see snapshotFormatVersion
+//	    entries    uint64   number of key entries which follow the header
+//	    checksum   uint32   CRC-32 (IEEE) of all the bytes after the header
+//	    applied    uint64   index of the last log entry applied to the storage (since version 3)
+//	    leases     uint64   number of lease entries which follow the key entries (since version 5)
+//	    nodes      uint64   number of node entries which follow the leases (since version 7)
+//	entries (repeated):
+//	    length     uint32   size of the encoded entry
+//	    entry      []byte   JSON encoded snapshotEntry
+//	leases (repeated):
+//	    length     uint32   size of the encoded lease
+//	    lease      []byte   JSON encoded snapshotLease
+//	nodes (repeated):
+//	    length     uint32   size of the encoded node
+//	    node       []byte   JSON encoded snapshotNode
+//
+// All integers are big-endian. Entries are written in lexicographical key order,
+// leases are ordered by ID, nodes are ordered by ID.
+
+var snapshotMagic = [4]byte{'R', 'K', 'V', 'S'}
+
+const (
+	snapshotFormatVersion uint16 = 7
+	// snapshotMinFormatVersion is the oldest format version Restore can read,
+	// version 1 entries don't have a modification index,
+	// version 2 header doesn't have the applied index,
+	// version 3 entries don't have an expiry time,
+	// version 4 doesn't have leases,
+	// version 5 entries have string values without content types,
+	// version 6 doesn't have nodes
+	snapshotMinFormatVersion uint16 = 1
+	// maxSnapshotEntrySize protects Restore from allocating huge buffers on a corrupted length
+	maxSnapshotEntrySize = 64 * 1024 * 1024
+)
+
+type snapshotHeader struct {
+	Magic    [4]byte
+	Version  uint16
+	Entries  uint64
+	Checksum uint32
+}
+
+// snapshotState is the FSM state saved to a snapshot.
+// Only storage, leases, nodes and appliedIndex are written,
+// the indexes are built again when the snapshot is read
+type snapshotState struct {
+	storage      *iradix.Tree
+	leases       *iradix.Tree
+	expiries     *iradix.Tree
+	leaseKeys    *iradix.Tree
+	nodes        *iradix.Tree
+	appliedIndex uint64
+}
+
+// snapshotEntry is a single key-value pair stored in a snapshot
+type snapshotEntry struct {
+	Key string `json:"k"`
+	// Value is the value in versions before 6
+	Value string `json:"v,omitempty"`
+	// Data is the value since version 6
+	Data        []byte `json:"d,omitempty"`
+	ContentType string `json:"c,omitempty"`
+	Index       uint64 `json:"i,omitempty"`
+	// Expires is KeyValue.ExpiresAt
+	Expires int64  `json:"e,omitempty"`
+	Lease   uint64 `json:"l,omitempty"`
+}
+
+// snapshotLease is a lease stored in a snapshot
+type snapshotLease struct {
+	ID      uint64        `json:"id"`
+	TTL     time.Duration `json:"t"`
+	Expires int64         `json:"e"`
+}
+
+// snapshotNode is an HTTP address of a node stored in a snapshot
+type snapshotNode struct {
+	ID          string `json:"id"`
+	HTTPAddress string `json:"h"`
+}
+
+// writeSnapshotEntries writes all key-value pairs of the storage to w in key order,
+// then all leases and nodes ordered by ID, each entry is prefixed with its length
+func writeSnapshotEntries(w io.Writer, state *snapshotState) error {
+	var err error
+	state.storage.Root().Walk(func(key []byte, value interface{}) bool {
+		kv := value.(KeyValue)
+		err = writeSnapshotRecord(w, snapshotEntry{
+			Key:         string(key),
+			Data:        kv.Value,
+			ContentType: kv.ContentType,
+			Index:       kv.ModifyIndex,
+			Expires:     kv.ExpiresAt,
+			Lease:       kv.Lease,
+		})
+		return err != nil
+	})
+	if err != nil {
+		return err
+	}
+
+	state.leases.Root().Walk(func(_ []byte, value interface{}) bool {
+		lease := value.(Lease)
+		err = writeSnapshotRecord(w, snapshotLease{ID: lease.ID, TTL: lease.TTL, Expires: lease.ExpiresAt})
+		return err != nil
+	})
+	if err != nil {
+		return err
+	}
+
+	state.nodes.Root().Walk(func(id []byte, value interface{}) bool {
+		err = writeSnapshotRecord(w, snapshotNode{ID: string(id), HTTPAddress: value.(string)})
+		return err != nil
+	})
+	return err
+}
+
+// writeSnapshotRecord writes a JSON encoded record prefixed with its length
+func writeSnapshotRecord(w io.Writer, record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// writeSnapshot writes a header and then streams entries to w.
+// Entries are encoded twice: the first pass only calculates the checksum for the header,
+// so we don't have to keep the whole encoded snapshot in memory.
+func writeSnapshot(w io.Writer, state *snapshotState) error {
+	checksum := crc32.NewIEEE()
+	if err := writeSnapshotEntries(checksum, state); err != nil {
+		return err
+	}
+
+	header := snapshotHeader{
+		Magic:    snapshotMagic,
+		Version:  snapshotFormatVersion,
+		Entries:  uint64(state.storage.Len()),
+		Checksum: checksum.Sum32(),
+	}
+
+	buffered := bufio.NewWriter(w)
+	if err := binary.Write(buffered, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	if err := binary.Write(buffered, binary.BigEndian, state.appliedIndex); err != nil {
+		return err
+	}
+	if err := binary.Write(buffered, binary.BigEndian, uint64(state.leases.Len())); err != nil {
+		return err
+	}
+	if err := binary.Write(buffered, binary.BigEndian, uint64(state.nodes.Len())); err != nil {
+		return err
+	}
+	if err := writeSnapshotEntries(buffered, state); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+// readSnapshot reads and validates a snapshot written by writeSnapshot
+func readSnapshot(r io.Reader) (*snapshotState, error) {
+	buffered := bufio.NewReader(r)
+
+	var header snapshotHeader
+	if err := binary.Read(buffered, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("Can't read snapshot header: %v", err)
+	}
+	if header.Magic != snapshotMagic {
+		return nil, fmt.Errorf("Unknown snapshot format")
+	}
+	if header.Version < snapshotMinFormatVersion || header.Version > snapshotFormatVersion {
+		return nil, fmt.Errorf("Unsupported snapshot format version: %d", header.Version)
+	}
+
+	state := &snapshotState{}
+	if header.Version >= 3 {
+		if err := binary.Read(buffered, binary.BigEndian, &state.appliedIndex); err != nil {
+			return nil, fmt.Errorf("Can't read snapshot header: %v", err)
+		}
+	}
+	var leasesCount uint64
+	if header.Version >= 5 {
+		if err := binary.Read(buffered, binary.BigEndian, &leasesCount); err != nil {
+			return nil, fmt.Errorf("Can't read snapshot header: %v", err)
+		}
+	}
+	var nodesCount uint64
+	if header.Version >= 7 {
+		if err := binary.Read(buffered, binary.BigEndian, &nodesCount); err != nil {
+			return nil, fmt.Errorf("Can't read snapshot header: %v", err)
+		}
+	}
+
+	checksum := crc32.NewIEEE()
+	txn := iradix.New().Txn()
+	expiries := iradix.New().Txn()
+	leaseKeys := iradix.New().Txn()
+	for i := uint64(0); i < header.Entries; i++ {
+		var entry snapshotEntry
+		if err := readSnapshotRecord(buffered, checksum, &entry); err != nil {
+			return nil, fmt.Errorf("Can't read snapshot entry %d: %v", i, err)
+		}
+		value := entry.Data
+		if header.Version < 6 || value == nil {
+			value = []byte(entry.Value)
+		}
+		txn.Insert([]byte(entry.Key), KeyValue{
+			Value:       value,
+			ContentType: entry.ContentType,
+			ModifyIndex: entry.Index,
+			ExpiresAt:   entry.Expires,
+			Lease:       entry.Lease,
+		})
+		if entry.Expires != 0 {
+			expiries.Insert(expiryIndexKey(entry.Key, entry.Expires), nil)
+		}
+		if entry.Lease != 0 {
+			leaseKeys.Insert(leaseKeyIndexKey(entry.Lease, entry.Key), nil)
+		}
+	}
+	state.storage = txn.Commit()
+	state.expiries = expiries.Commit()
+	state.leaseKeys = leaseKeys.Commit()
+
+	leases := iradix.New().Txn()
+	for i := uint64(0); i < leasesCount; i++ {
+		var lease snapshotLease
+		if err := readSnapshotRecord(buffered, checksum, &lease); err != nil {
+			return nil, fmt.Errorf("Can't read snapshot lease %d: %v", i, err)
+		}
+		leases.Insert(leaseIndexKey(lease.ID), Lease{ID: lease.ID, TTL: lease.TTL, ExpiresAt: lease.Expires})
+	}
+	state.leases = leases.Commit()
+
+	nodes := iradix.New().Txn()
+	for i := uint64(0); i < nodesCount; i++ {
+		var node snapshotNode
+		if err := readSnapshotRecord(buffered, checksum, &node); err != nil {
+			return nil, fmt.Errorf("Can't read snapshot node %d: %v", i, err)
+		}
+		nodes.Insert([]byte(node.ID), node.HTTPAddress)
+	}
+	state.nodes = nodes.Commit()
+
+	if checksum.Sum32() != header.Checksum {
+		return nil, fmt.Errorf("Snapshot checksum mismatch")
+	}
+	if _, err := buffered.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("Unexpected data after the last snapshot entry")
+	}
+
+	return state, nil
+}
+
+// readSnapshotRecord reads a record written by writeSnapshotRecord into v
+func readSnapshotRecord(r io.Reader, checksum hash.Hash32, v interface{}) error {
+	r = io.TeeReader(r, checksum)
+
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxSnapshotEntrySize {
+		return fmt.Errorf("entry is too big: %d bytes", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,167 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/go-immutable-radix"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStorage(storage map[string]KeyValue) *RStorage {
+	s := &RStorage{
+		storage:    iradix.New(),
+		expiries:   iradix.New(),
+		leases:     iradix.New(),
+		leaseKeys:  iradix.New(),
+		nodes:      iradix.New(),
+		appliedCh:  make(chan struct{}),
+		history:    newEventHistory(watchHistorySize),
+		keyWaiters: map[string]*keyWaiter{},
+	}
+	for key, kv := range storage {
+		s.storage, _, _ = s.storage.Insert([]byte(key), kv)
+		s.addExpiry(key, kv)
+		s.attachLease(key, kv)
+	}
+	return s
+}
+
+// storageMap converts the storage tree to a map to compare it in tests
+func storageMap(tree *iradix.Tree) map[string]KeyValue {
+	storage := map[string]KeyValue{}
+	tree.Root().Walk(func(key []byte, value interface{}) bool {
+		storage[string(key)] = value.(KeyValue)
+		return false
+	})
+	return storage
+}
+
+// persistAndRestore saves a snapshot of "from" to the store and restores it into "to"
+func persistAndRestore(t *testing.T, store raft.SnapshotStore, from *RStorage, to *RStorage) {
+	snapshot, err := from.Snapshot()
+	assert.Nil(t, err)
+	defer snapshot.Release()
+
+	sink, err := store.Create(1, 10, 1, raft.Configuration{}, 1, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, snapshot.Persist(sink))
+
+	snapshots, err := store.List()
+	assert.Nil(t, err)
+	assert.Len(t, snapshots, 1)
+
+	_, source, err := store.Open(snapshots[0].ID)
+	assert.Nil(t, err)
+	defer source.Close()
+
+	assert.Nil(t, to.Restore(source))
+}
+
+func TestSnapshotRoundTripInmem(t *testing.T) {
+	data := map[string]KeyValue{
+		"key":       {Value: []byte("value"), ModifyIndex: 1},
+		"empty":     {Value: []byte(""), ModifyIndex: 2},
+		"unicode-✓": {Value: []byte("значение"), ModifyIndex: 3},
+		"app/a":     {Value: []byte("1"), ModifyIndex: 4},
+		"app/b":     {Value: []byte("2"), ModifyIndex: 5},
+	}
+	restored := newTestStorage(map[string]KeyValue{"stale": {Value: []byte("value")}})
+	original := newTestStorage(data)
+	original.appliedIndex = 5
+
+	persistAndRestore(t, raft.NewInmemSnapshotStore(), original, restored)
+
+	assert.Equal(t, data, storageMap(restored.storage), "Restored storage must be equal to the original one")
+	assert.Equal(t, uint64(5), restored.AppliedIndex(), "Applied index must be restored")
+}
+
+func TestSnapshotRoundTripFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft-kv-snapshot")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := raft.NewFileSnapshotStore(dir, 1, ioutil.Discard)
+	assert.Nil(t, err)
+
+	data := map[string]KeyValue{
+		"key":         {Value: []byte("value"), ModifyIndex: 7},
+		"another-key": {Value: []byte("another-value"), ModifyIndex: 8},
+	}
+	restored := newTestStorage(map[string]KeyValue{})
+
+	persistAndRestore(t, store, newTestStorage(data), restored)
+
+	assert.Equal(t, data, storageMap(restored.storage), "Restored storage must be equal to the original one")
+}
+
+func TestSnapshotEmptyStorage(t *testing.T) {
+	restored := newTestStorage(map[string]KeyValue{"stale": {Value: []byte("value")}})
+
+	persistAndRestore(t, raft.NewInmemSnapshotStore(), newTestStorage(map[string]KeyValue{}), restored)
+
+	assert.Equal(t, 0, restored.storage.Len(), "Restore must discard the previous state")
+}
+
+func TestSnapshotValidation(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, writeSnapshot(&buf, &snapshotState{
+		storage:      newTestStorage(map[string]KeyValue{"a": {Value: []byte("1")}, "b": {Value: []byte("2")}}).storage,
+		leases:       iradix.New(),
+		nodes:        iradix.New(),
+		appliedIndex: 5,
+	}))
+	valid := buf.Bytes()
+
+	state, err := readSnapshot(bytes.NewReader(valid))
+	assert.Nil(t, err, "Valid snapshot must be read without errors")
+	assert.Equal(t, uint64(5), state.appliedIndex)
+
+	corrupted := append([]byte{}, valid...)
+	corrupted[len(corrupted)-2] ^= 0xff
+	_, err = readSnapshot(bytes.NewReader(corrupted))
+	assert.NotNil(t, err, "Corrupted snapshot must not be restored")
+
+	_, err = readSnapshot(bytes.NewReader(valid[:len(valid)-3]))
+	assert.NotNil(t, err, "Truncated snapshot must not be restored")
+
+	_, err = readSnapshot(bytes.NewReader(append(append([]byte{}, valid...), 0)))
+	assert.NotNil(t, err, "Snapshot with trailing data must not be restored")
+
+	wrongVersion := append([]byte{}, valid...)
+	wrongVersion[5] = 99
+	_, err = readSnapshot(bytes.NewReader(wrongVersion))
+	assert.NotNil(t, err, "Unknown snapshot version must not be restored")
+
+	_, err = readSnapshot(bytes.NewReader([]byte(`{"storage": {}}`)))
+	assert.NotNil(t, err, "Old JSON snapshots must not be restored")
+
+	storage := newTestStorage(map[string]KeyValue{"key": {Value: []byte("value")}})
+	assert.NotNil(t, storage.Restore(ioutil.NopCloser(bytes.NewReader(corrupted))))
+	assert.Equal(t, map[string]KeyValue{"key": {Value: []byte("value")}}, storageMap(storage.storage), "Failed restore must not change the storage")
+}
+
+func TestSnapshotFormatVersion1(t *testing.T) {
+	// version 1 entries don't have a modification index
+	entry := []byte(`{"k":"key","v":"value"}`)
+	var buf bytes.Buffer
+	length := []byte{0, 0, 0, byte(len(entry))}
+	binary.Write(&buf, binary.BigEndian, &snapshotHeader{
+		Magic:    snapshotMagic,
+		Version:  1,
+		Entries:  1,
+		Checksum: crc32.ChecksumIEEE(append(length, entry...)),
+	})
+	buf.Write(length)
+	buf.Write(entry)
+
+	state, err := readSnapshot(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]KeyValue{"key": {Value: []byte("value")}}, storageMap(state.storage))
+	assert.Equal(t, uint64(0), state.appliedIndex)
+}
@@ -1,13 +1,14 @@
 package node
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"sync"
 	"time"
 
+	"github.com/hashicorp/go-immutable-radix"
 	"github.com/hashicorp/raft"
 )
 
@@ -15,73 +16,447 @@ import (
 // Also, it represents finite-state machine which processes Raft log events
 // https://godoc.org/github.com/hashicorp/raft#FSM
 type RStorage struct {
-	mutex    sync.Mutex
-	storage  map[string]string
+	mutex sync.RWMutex
+	// storage is an immutable radix tree with KeyValue values,
+	// it keeps keys ordered and makes point-in-time snapshots cheap
+	storage *iradix.Tree
+	// expiries indexes keys with TTL by their expiry time, see expiryIndexKey
+	expiries *iradix.Tree
+	// leases contains Lease values by ID, see leaseIndexKey
+	leases *iradix.Tree
+	// leaseKeys indexes keys attached to leases, see leaseKeyIndexKey
+	leaseKeys *iradix.Tree
+	// nodes contains HTTP addresses of nodes by their IDs, see RegisterNode
+	nodes    *iradix.Tree
 	RaftNode *raft.Raft
 	config   Config
+
+	// appliedIndex is the index of the last log entry applied to the storage,
+	// appliedCh is closed and replaced every time it changes
+	appliedIndex uint64
+	appliedCh    chan struct{}
+
+	// history keeps recent changes for watchers
+	history *eventHistory
+	// keyWaiters are blocking queries waiting for changes of keys
+	keyWaiters map[string]*keyWaiter
+	// batchCh receives writes which are grouped into batches by runBatcher,
+	// it is nil if batching is disabled
+	batchCh chan *pendingEvent
+}
+
+// KeyValue is a value stored in RStorage with its metadata
+type KeyValue struct {
+	Value []byte
+	// ContentType is the Content-Type of a raw value written with PUT,
+	// it is empty for string values written with the JSON API
+	ContentType string
+	// ModifyIndex is an index of the Raft log entry which changed the key last time,
+	// it is used as a key revision
+	ModifyIndex uint64
+	// ExpiresAt is the time when the key expires in Unix nanoseconds, 0 means never
+	ExpiresAt int64
+	// Lease is ID of the lease the key is attached to, 0 means none
+	Lease uint64
+}
+
+// SetOptions are optional parameters of a write
+type SetOptions struct {
+	// TTL is the time after which the key is deleted, 0 means never
+	TTL time.Duration
+	// ContentType of a raw value, see KeyValue.ContentType
+	ContentType string
+	// Lease attaches the key to the lease, the key is deleted when the lease is revoked or expires
+	Lease uint64
+}
+
+var (
+	// ErrNotLeader is returned when a write is sent to a node which is not the leader
+	ErrNotLeader = errors.New("Only leader can write to the storage")
+	// ErrNoLeader is returned when the cluster doesn't have a leader at the moment, e.g. during an election
+	ErrNoLeader = errors.New("Cluster has no leader")
+	// ErrLeadershipLost is returned when the leader lost its leadership before the write was committed,
+	// the write may or may not be applied eventually
+	ErrLeadershipLost = errors.New("Leadership lost while committing the log entry")
+	// ErrTimeout is returned when the write can't be started in time
+	ErrTimeout = errors.New("Timed out enqueuing the log entry")
+	// ErrShutdown is returned when the node is shutting down
+	ErrShutdown = errors.New("Raft node is shut down")
+	// ErrKeyNotFound is returned by Delete when the key doesn't exist
+	ErrKeyNotFound = errors.New("Key not found")
+	// ErrKeyExists is returned by CompareAndSet when the key must not exist, but it does
+	ErrKeyExists = errors.New("Key already exists")
+	// ErrRevisionMismatch is returned by CompareAndSet when the key was modified
+	// after the expected revision or doesn't exist anymore
+	ErrRevisionMismatch = errors.New("Key revision doesn't match")
+)
+
+// FSMError is returned when a log entry was committed, but the FSM failed to apply it
+type FSMError struct {
+	Err error
+}
+
+func (e *FSMError) Error() string {
+	return fmt.Sprintf("Can't apply the log entry: %v", e.Err)
 }
 
+// applyTimeout limits the time we wait to enqueue a new log entry
+const applyTimeout = time.Second * 5
+
 // Get value by key
-func (s *RStorage) Get(key string) string {
-	return s.storage[key]
+// the second returned value reports whether the key exists
+func (s *RStorage) Get(key string) (string, bool) {
+	kv, exists := s.GetKeyValue(key)
+	return string(kv.Value), exists
+}
+
+// GetKeyValue returns value by key with its metadata
+func (s *RStorage) GetKeyValue(key string) (KeyValue, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.getKey(key, time.Now().UnixNano())
+}
+
+// getKey reads a key from the storage tree, keys expired at the time now are treated as missing
+// s.mutex must be held
+func (s *RStorage) getKey(key string, now int64) (KeyValue, bool) {
+	kv, exists := s.lookupKey(key)
+	if !exists || keyExpired(kv, s.leases, now) {
+		return KeyValue{}, false
+	}
+	return kv, true
+}
+
+// lookupKey reads a key from the storage tree including expired keys, s.mutex must be held
+func (s *RStorage) lookupKey(key string) (KeyValue, bool) {
+	value, exists := s.storage.Get([]byte(key))
+	if !exists {
+		return KeyValue{}, false
+	}
+	return value.(KeyValue), true
+}
+
+// putKey writes a key to the storage tree and notifies watchers, s.mutex must be held
+func (s *RStorage) putKey(key string, kv KeyValue) {
+	if old, exists := s.lookupKey(key); exists {
+		s.removeExpiry(key, old)
+		s.detachLease(key, old)
+	}
+	s.storage, _, _ = s.storage.Insert([]byte(key), kv)
+	s.addExpiry(key, kv)
+	s.attachLease(key, kv)
+	s.history.add(newSetEvent(key, kv))
+	s.notifyKey(key)
+}
+
+// deleteKey removes a key from the storage tree and notifies watchers, s.mutex must be held
+// returns false if the key didn't exist
+func (s *RStorage) deleteKey(key string, index uint64) bool {
+	old, deleted := s.lookupKey(key)
+	if deleted {
+		s.removeExpiry(key, old)
+		s.detachLease(key, old)
+		s.storage, _, _ = s.storage.Delete([]byte(key))
+		s.history.add(WatchEvent{Type: "delete", Key: key, Index: index})
+		s.notifyKey(key)
+	}
+	return deleted
 }
 
 // Set value by key
-func (s *RStorage) Set(key string, value string) error {
+// returns the Raft log index of the write, which is the new revision of the key
+func (s *RStorage) Set(key string, value string) (uint64, error) {
+	return s.SetWithOptions(key, []byte(value), SetOptions{})
+}
+
+// SetWithOptions sets value by key with TTL, lease or content type
+// returns the Raft log index of the write, which is the new revision of the key
+func (s *RStorage) SetWithOptions(key string, value []byte, opts SetOptions) (uint64, error) {
+	response, err := s.applyEvent(&logEvent{
+		Type:        "set",
+		Key:         key,
+		Data:        value,
+		ContentType: opts.ContentType,
+		TTL:         opts.TTL,
+		Lease:       opts.Lease,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	index, ok := response.(uint64)
+	if !ok {
+		return 0, fmt.Errorf("Unexpected FSM response: %+v", response)
+	}
+	return index, nil
+}
+
+// Delete removes key from the storage
+// returns the Raft log index of the write and ErrKeyNotFound if the key didn't exist
+func (s *RStorage) Delete(key string) (uint64, error) {
+	response, err := s.applyEvent(&logEvent{
+		Type: "delete",
+		Key:  key,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	result, ok := response.(deleteResult)
+	if !ok {
+		return 0, fmt.Errorf("Unexpected FSM response: %+v", response)
+	}
+	if !result.Deleted {
+		return result.Index, ErrKeyNotFound
+	}
+	return result.Index, nil
+}
+
+// CompareAndSet sets value by key only if the key's current revision is equal to expectedRevision.
+// If expectedRevision is 0, the key must not exist.
+// Returns the new revision of the key
+func (s *RStorage) CompareAndSet(key string, value []byte, expectedRevision uint64, opts SetOptions) (uint64, error) {
+	response, err := s.applyEvent(&logEvent{
+		Type:        "cas",
+		Key:         key,
+		Data:        value,
+		ContentType: opts.ContentType,
+		PrevIndex:   expectedRevision,
+		TTL:         opts.TTL,
+		Lease:       opts.Lease,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	result, ok := response.(casResult)
+	if !ok {
+		return 0, fmt.Errorf("Unexpected FSM response: %+v", response)
+	}
+	if !result.Succeeded {
+		if expectedRevision == 0 {
+			return result.Index, ErrKeyExists
+		}
+		return result.Index, ErrRevisionMismatch
+	}
+	return result.Index, nil
+}
+
+// applyEvent replicates event through the Raft log and waits until it is applied to the FSM
+// returns the FSM response
+func (s *RStorage) applyEvent(event *logEvent) (interface{}, error) {
 	if s.RaftNode.State() != raft.Leader {
-		return fmt.Errorf("Only leader can write to the storage")
+		return nil, ErrNotLeader
 	}
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	event.Time = time.Now().UnixNano()
+	var response interface{}
+	var err error
+	if s.batchCh != nil && batchableEvents[event.Type] {
+		response, err = s.applyBatched(event)
+	} else {
+		response, err = s.proposeEvent(event)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	event := &logEvent{
-		Type:  "set",
-		Key:   key,
-		Value: value,
+	if err, ok := response.(error); ok {
+		// errors caused by the request itself are returned as is
+		switch err {
+		case ErrLeaseNotFound, ErrCounterOverflow, ErrNotCounter:
+			return nil, err
+		}
+		return nil, &FSMError{Err: err}
 	}
-	data, err := json.Marshal(event)
+	return response, nil
+}
+
+// proposeEvent writes event to the Raft log as a separate entry and returns the FSM response
+func (s *RStorage) proposeEvent(event *logEvent) (interface{}, error) {
+	data, err := encodeLogEvent(event)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	timeout := time.Second * 5
-	_ = s.RaftNode.Apply(data, timeout)
+	future := s.RaftNode.Apply(data, applyTimeout)
+	if err := future.Error(); err != nil {
+		return nil, translateRaftError(err)
+	}
+	return future.Response(), nil
+}
 
-	return nil
+// translateRaftError converts errors of the Raft library to errors of this package,
+// so callers don't need to know about Raft internals
+func translateRaftError(err error) error {
+	switch err {
+	case raft.ErrNotLeader:
+		return ErrNotLeader
+	case raft.ErrLeadershipLost:
+		return ErrLeadershipLost
+	case raft.ErrEnqueueTimeout:
+		return ErrTimeout
+	case raft.ErrRaftShutdown:
+		return ErrShutdown
+	}
+	return err
 }
 
+// logEvent is a command replicated through the Raft log, see encodeLogEvent.
+// Empty fields are omitted in both JSON and msgpack encodings
 type logEvent struct {
-	Type  string
-	Key   string
-	Value string
+	Type string
+	Key  string
+	// Value is a string value of log entries written before Data was added
+	Value string `json:",omitempty" codec:",omitempty"`
+	// Data is the value for "set" and "cas" events
+	Data        []byte `json:",omitempty" codec:",omitempty"`
+	ContentType string `json:",omitempty" codec:",omitempty"`
+	// PrevIndex is an expected revision of the key for "cas" events
+	PrevIndex uint64 `json:",omitempty" codec:",omitempty"`
+	// Txn is a transaction for "txn" events
+	Txn *TxnRequest `json:",omitempty" codec:",omitempty"`
+	// TTL of the key for "set" and "cas" events, or of the lease for "lease_grant" events
+	TTL time.Duration `json:",omitempty" codec:",omitempty"`
+	// Lease is ID of the lease to attach the key to for "set" and "cas" events,
+	// or ID of the lease for other lease events
+	Lease uint64 `json:",omitempty" codec:",omitempty"`
+	// Delta is added to the counter for "incr" events
+	Delta int64 `json:",omitempty" codec:",omitempty"`
+	// Expired is a list of keys to delete for "expire" events
+	Expired []expiredKey `json:",omitempty" codec:",omitempty"`
+	// Batch is a list of events applied in one log entry for "batch" events, see runBatcher and Bulk
+	Batch []*logEvent `json:",omitempty" codec:",omitempty"`
+	// Address is the HTTP address of the node for "node_register" events
+	Address string `json:",omitempty" codec:",omitempty"`
+	// Atomic is set for "batch" events which are applied only if all their events can be applied
+	Atomic bool `json:",omitempty" codec:",omitempty"`
+	// Time is the leader's clock in Unix nanoseconds when the event was proposed,
+	// all replicas use it instead of their own clocks, so expiry is deterministic
+	Time int64 `json:",omitempty" codec:",omitempty"`
+}
+
+// value returns the value of "set" and "cas" events
+func (e *logEvent) value() []byte {
+	if e.Data == nil {
+		return []byte(e.Value)
+	}
+	return e.Data
+}
+
+// deleteResult is returned by Apply for "delete" events
+type deleteResult struct {
+	// Deleted is false if the key didn't exist
+	Deleted bool
+	Index   uint64
+}
+
+// casResult is returned by Apply for "cas" events
+type casResult struct {
+	Succeeded bool
+	// Index is the new revision of the key if the operation succeeded,
+	// otherwise it is the current revision (0 if the key doesn't exist)
+	Index uint64
 }
 
 // Apply applies a Raft log entry to the key-value store.
 func (s *RStorage) Apply(logEntry *raft.Log) interface{} {
 	log.Println("[DEBUG] Applying a new log entry to the store")
 
-	var event logEvent
-	if err := json.Unmarshal(logEntry.Data, &event); err != nil {
-		log.Println("[ERROR] Can't read Raft log event")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// the entry is applied even if it is broken, so waiters of this index don't hang
+	defer s.setAppliedIndex(logEntry.Index)
+
+	event, err := decodeLogEvent(logEntry.Data)
+	if err != nil {
+		log.Printf("[ERROR] Can't read Raft log event: %+v", err)
+		return err
 	}
+	return s.applyCommand(logEntry, event)
+}
 
-	if event.Type == "set" {
-		log.Printf("[DEBUG] set operation received key=%s value=%s", event.Key, event.Value)
-		s.mutex.Lock()
-		defer s.mutex.Unlock()
-		s.storage[event.Key] = event.Value
-		return nil
+// applyCommand applies an event of the log entry and returns its result, s.mutex must be held
+func (s *RStorage) applyCommand(logEntry *raft.Log, event *logEvent) interface{} {
+	switch event.Type {
+	case "set":
+		log.Printf("[DEBUG] set operation received key=%s size=%d ttl=%s lease=%d", event.Key, len(event.value()), event.TTL, event.Lease)
+		if event.Lease != 0 && !s.leaseAlive(event.Lease, event.Time) {
+			return ErrLeaseNotFound
+		}
+		s.putKey(event.Key, newKeyValue(event, logEntry.Index))
+		return logEntry.Index
+	case "cas":
+		log.Printf("[DEBUG] cas operation received key=%s size=%d prev_index=%d", event.Key, len(event.value()), event.PrevIndex)
+		current, exists := s.getKey(event.Key, event.Time)
+		if exists != (event.PrevIndex != 0) || current.ModifyIndex != event.PrevIndex {
+			return casResult{Succeeded: false, Index: current.ModifyIndex}
+		}
+		if event.Lease != 0 && !s.leaseAlive(event.Lease, event.Time) {
+			return ErrLeaseNotFound
+		}
+		s.putKey(event.Key, newKeyValue(event, logEntry.Index))
+		return casResult{Succeeded: true, Index: logEntry.Index}
+	case "delete":
+		log.Printf("[DEBUG] delete operation received key=%s", event.Key)
+		// an expired key is deleted too, but it didn't exist for the client
+		_, exists := s.getKey(event.Key, event.Time)
+		s.deleteKey(event.Key, logEntry.Index)
+		return deleteResult{Deleted: exists, Index: logEntry.Index}
+	case "txn":
+		if event.Txn == nil {
+			return fmt.Errorf("txn event without a transaction")
+		}
+		log.Printf("[DEBUG] txn operation received compares=%d success=%d failure=%d",
+			len(event.Txn.Compare), len(event.Txn.Success), len(event.Txn.Failure))
+		return s.applyTxn(logEntry.Index, event.Time, event.Txn)
+	case "incr":
+		log.Printf("[DEBUG] incr operation received key=%s delta=%d", event.Key, event.Delta)
+		return s.applyIncrement(logEntry.Index, event.Time, event.Key, event.Delta)
+	case "expire":
+		log.Printf("[DEBUG] expire operation received keys=%d", len(event.Expired))
+		return s.applyExpire(logEntry.Index, event.Expired)
+	case "lease_grant":
+		log.Printf("[DEBUG] lease_grant operation received ttl=%s", event.TTL)
+		return s.applyLeaseGrant(logEntry.Index, event.Time, event.TTL)
+	case "lease_keepalive":
+		log.Printf("[DEBUG] lease_keepalive operation received lease=%d", event.Lease)
+		return s.applyLeaseKeepAlive(logEntry.Index, event.Time, event.Lease)
+	case "lease_revoke":
+		log.Printf("[DEBUG] lease_revoke operation received lease=%d", event.Lease)
+		return s.applyLeaseRevoke(logEntry.Index, event.Lease)
+	case "lease_expire":
+		log.Printf("[DEBUG] lease_expire operation received lease=%d", event.Lease)
+		return s.applyLeaseExpire(logEntry.Index, event.Time, event.Lease)
+	case "node_register":
+		log.Printf("[DEBUG] node_register operation received node=%s address=%s", event.Key, event.Address)
+		return s.applyNodeRegister(logEntry.Index, event.Key, event.Address)
+	case "node_deregister":
+		log.Printf("[DEBUG] node_deregister operation received node=%s", event.Key)
+		return s.applyNodeDeregister(logEntry.Index, event.Key)
+	case "batch":
+		log.Printf("[DEBUG] batch operation received events=%d atomic=%t", len(event.Batch), event.Atomic)
+		if event.Atomic {
+			if results, ok := s.checkAtomicBatch(event.Batch, event.Time); !ok {
+				return results
+			}
+		}
+		results := make([]interface{}, len(event.Batch))
+		for i, batched := range event.Batch {
+			results[i] = s.applyCommand(logEntry, batched)
+		}
+		return results
 	}
 
 	log.Printf("Unknown Raft log event type: %s", event.Type)
-	return nil
+	return fmt.Errorf("Unknown Raft log event type: %s", event.Type)
 }
 
 // fsmSnapshot is used by Raft library to save a point-in-time snapshot of the FSM
 // https://godoc.org/github.com/hashicorp/raft#FSMSnapshot
 type fsmSnapshot struct {
-	storage map[string]string
+	// the state is immutable, so the snapshot doesn't need to copy it
+	state *snapshotState
 }
 
 // Snapshot returns FSMSnapshot which is used to save snapshot of the FSM
@@ -90,23 +465,34 @@ func (s *RStorage) Snapshot() (raft.FSMSnapshot, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	storageCopy := map[string]string{}
-	for k, v := range s.storage {
-		storageCopy[k] = v
-	}
-
-	return &fsmSnapshot{storage: storageCopy}, nil
+	return &fsmSnapshot{state: &snapshotState{
+		storage:      s.storage,
+		leases:       s.leases,
+		nodes:        s.nodes,
+		appliedIndex: s.appliedIndex,
+	}}, nil
 }
 
 // Restore stores the key-value store to a previous state.
 func (s *RStorage) Restore(serialized io.ReadCloser) error {
 	log.Println("[DEBUG] Restore")
-	var snapshot fsmSnapshot
-	if err := json.NewDecoder(serialized).Decode(&snapshot); err != nil {
+	state, err := readSnapshot(serialized)
+	if err != nil {
+		log.Printf("[ERROR] Can't restore snapshot: %+v", err)
 		return err
 	}
 
-	s.storage = snapshot.storage
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.storage = state.storage
+	s.expiries = state.expiries
+	s.leases = state.leases
+	s.leaseKeys = state.leaseKeys
+	s.nodes = state.nodes
+	// changes before the snapshot are unknown, so watchers have to re-list keys
+	s.history.reset(state.appliedIndex)
+	s.notifyAllKeys()
+	s.setAppliedIndex(state.appliedIndex)
 	return nil
 }
 
@@ -118,16 +504,11 @@ func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 
 	// trying to save a snapshot
 	err := func() error {
-		snapshotBytes, err := json.Marshal(f)
-		if err != nil {
-			return err
-		}
-
-		if _, err := sink.Write(snapshotBytes); err != nil {
+		if err := writeSnapshot(sink, f.state); err != nil {
 			return err
 		}
 
-		err = sink.Close()
+		err := sink.Close()
 		if err != nil {
 			return err
 		}
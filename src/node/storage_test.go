@@ -0,0 +1,607 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func applyTestEvent(s *RStorage, index uint64, event *logEvent) interface{} {
+	data, _ := encodeLogEvent(event)
+	return s.Apply(&raft.Log{Index: index, Data: data})
+}
+
+func TestApplyResponses(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{})
+
+	assert.Equal(t, uint64(3), applyTestEvent(s, 3, &logEvent{Type: "set", Key: "key", Value: "value"}))
+	kv, _ := s.GetKeyValue("key")
+	assert.Equal(t, KeyValue{Value: []byte("value"), ModifyIndex: 3}, kv)
+
+	assert.Equal(t, deleteResult{Deleted: true, Index: 4}, applyTestEvent(s, 4, &logEvent{Type: "delete", Key: "key"}))
+	assert.Equal(t, deleteResult{Deleted: false, Index: 5}, applyTestEvent(s, 5, &logEvent{Type: "delete", Key: "key"}))
+}
+
+func TestApplyErrors(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{})
+
+	response := s.Apply(&raft.Log{Index: 1, Data: []byte("not a json")})
+	_, isError := response.(error)
+	assert.True(t, isError, "Apply must return an error for unreadable log entries")
+
+	response = applyTestEvent(s, 2, &logEvent{Type: "unknown", Key: "key"})
+	_, isError = response.(error)
+	assert.True(t, isError, "Apply must return an error for unknown events")
+	assert.Equal(t, 0, s.storage.Len())
+}
+
+func TestTranslateRaftError(t *testing.T) {
+	assert.Equal(t, ErrNotLeader, translateRaftError(raft.ErrNotLeader))
+	assert.Equal(t, ErrLeadershipLost, translateRaftError(raft.ErrLeadershipLost))
+	assert.Equal(t, ErrTimeout, translateRaftError(raft.ErrEnqueueTimeout))
+	assert.Equal(t, ErrShutdown, translateRaftError(raft.ErrRaftShutdown))
+	assert.Equal(t, raft.ErrNothingNewToSnapshot, translateRaftError(raft.ErrNothingNewToSnapshot))
+}
+
+func TestWaitForIndex(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{})
+
+	assert.Equal(t, ErrIndexTimeout, s.WaitForIndex(1, time.Millisecond*10))
+
+	done := make(chan error)
+	go func() {
+		done <- s.WaitForIndex(2, time.Second)
+	}()
+
+	applyTestEvent(s, 1, &logEvent{Type: "set", Key: "key", Value: "value"})
+	applyTestEvent(s, 2, &logEvent{Type: "set", Key: "key", Value: "value"})
+
+	assert.Nil(t, <-done, "WaitForIndex must return when the index is applied")
+	assert.Equal(t, uint64(2), s.AppliedIndex())
+	assert.Nil(t, s.WaitForIndex(1, 0), "Already applied index must not block")
+}
+
+func listKeys(pairs []KeyValuePair) []string {
+	keys := []string{}
+	for _, pair := range pairs {
+		keys = append(keys, pair.Key)
+	}
+	return keys
+}
+
+func TestList(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{
+		"app/b":   {Value: []byte("2")},
+		"app/a":   {Value: []byte("1")},
+		"app/c/d": {Value: []byte("3")},
+		"apple":   {Value: []byte("4")},
+		"other":   {Value: []byte("5")},
+	})
+
+	pairs, next := s.List(ListOptions{})
+	assert.Equal(t, []string{"app/a", "app/b", "app/c/d", "apple", "other"}, listKeys(pairs))
+	assert.Equal(t, "", next)
+
+	pairs, _ = s.List(ListOptions{Prefix: "app/"})
+	assert.Equal(t, []string{"app/a", "app/b", "app/c/d"}, listKeys(pairs))
+	assert.Equal(t, "1", string(pairs[0].Value))
+
+	pairs, _ = s.List(ListOptions{Start: "app/b", End: "other"})
+	assert.Equal(t, []string{"app/b", "app/c/d", "apple"}, listKeys(pairs))
+
+	pairs, next = s.List(ListOptions{Prefix: "app", Limit: 2})
+	assert.Equal(t, []string{"app/a", "app/b"}, listKeys(pairs))
+	assert.Equal(t, "app/c/d", next)
+
+	pairs, next = s.List(ListOptions{Prefix: "app", Start: next, Limit: 2})
+	assert.Equal(t, []string{"app/c/d", "apple"}, listKeys(pairs))
+	assert.Equal(t, "", next)
+}
+
+func TestListAfterRestore(t *testing.T) {
+	original := newTestStorage(map[string]KeyValue{})
+	for i, key := range []string{"c", "a", "b/2", "b/1"} {
+		applyTestEvent(original, uint64(i+1), &logEvent{Type: "set", Key: key, Value: key})
+	}
+
+	restored := newTestStorage(map[string]KeyValue{})
+	persistAndRestore(t, raft.NewInmemSnapshotStore(), original, restored)
+
+	pairs, _ := restored.List(ListOptions{})
+	assert.Equal(t, []string{"a", "b/1", "b/2", "c"}, listKeys(pairs), "Restored keys must be ordered")
+}
+
+func TestApplyTxn(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{
+		"a": {Value: []byte("1"), ModifyIndex: 1},
+		"b": {Value: []byte("2"), ModifyIndex: 2},
+	})
+
+	txn := &TxnRequest{
+		Compare: []TxnCompare{
+			{Key: "a", Target: "value", Value: "1"},
+			{Key: "b", Target: "revision", Op: "<", Revision: 3},
+			{Key: "c", Target: "exists", Exists: false},
+		},
+		Success: []TxnOp{
+			{Type: "set", Key: "c", Value: "3"},
+			{Type: "delete", Key: "a"},
+			{Type: "get", Key: "c"},
+		},
+		Failure: []TxnOp{
+			{Type: "get", Key: "a"},
+		},
+	}
+	assert.Nil(t, txn.Validate())
+
+	response := applyTestEvent(s, 10, &logEvent{Type: "txn", Txn: txn}).(*TxnResponse)
+	assert.True(t, response.Succeeded)
+	assert.Equal(t, uint64(10), response.Index)
+	assert.Equal(t, []TxnOpResult{
+		{Type: "set", Key: "c", Exists: true, Revision: 10},
+		{Type: "delete", Key: "a", Exists: true},
+		{Type: "get", Key: "c", Value: "3", Exists: true, Revision: 10},
+	}, response.Results)
+
+	// "a" is deleted and "c" exists now, so the same transaction takes the failure branch
+	response = applyTestEvent(s, 11, &logEvent{Type: "txn", Txn: txn}).(*TxnResponse)
+	assert.False(t, response.Succeeded)
+	assert.Equal(t, []TxnOpResult{{Type: "get", Key: "a"}}, response.Results)
+
+	pairs, _ := s.List(ListOptions{})
+	assert.Equal(t, []string{"b", "c"}, listKeys(pairs))
+}
+
+func TestTxnValidate(t *testing.T) {
+	invalid := []*TxnRequest{
+		{Compare: []TxnCompare{{Key: "", Target: "value"}}},
+		{Compare: []TxnCompare{{Key: "a", Target: "size"}}},
+		{Compare: []TxnCompare{{Key: "a", Target: "value", Op: ">="}}},
+		{Compare: []TxnCompare{{Key: "a", Target: "exists", Op: "<"}}},
+		{Success: []TxnOp{{Type: "put", Key: "a"}}},
+		{Failure: []TxnOp{{Type: "get"}}},
+		{Success: make([]TxnOp, maxTxnOps+1)},
+	}
+	for _, txn := range invalid {
+		assert.NotNil(t, txn.Validate(), "Transaction must be invalid: %+v", txn)
+	}
+}
+
+func TestEventHistory(t *testing.T) {
+	h := newEventHistory(3)
+	for i := uint64(1); i <= 4; i++ {
+		h.add(WatchEvent{Type: "set", Key: fmt.Sprintf("key-%d", i), Index: i})
+	}
+
+	_, err := h.since(1, -1, "")
+	assert.Equal(t, ErrCompacted, err, "The first event is dropped from the history")
+
+	events, err := h.since(2, -1, "")
+	assert.Nil(t, err)
+	assert.Len(t, events, 3)
+	assert.Equal(t, uint64(2), events[0].Index)
+
+	events, _ = h.since(3, -1, "key-4")
+	assert.Equal(t, []WatchEvent{{Type: "set", Key: "key-4", Index: 4}}, events)
+
+	h.reset(10)
+	_, err = h.since(10, -1, "")
+	assert.Equal(t, ErrCompacted, err, "Events before the restored snapshot are unknown")
+	events, err = h.since(11, -1, "")
+	assert.Nil(t, err)
+	assert.Empty(t, events)
+
+	// the first events of a log entry are dropped, the client which received them resumes
+	for seq := 0; seq < 5; seq++ {
+		h.add(WatchEvent{Type: "set", Key: fmt.Sprintf("key-%d", seq), Index: 11})
+	}
+	_, err = h.since(11, 0, "")
+	assert.Equal(t, ErrCompacted, err, "Event 11.1 is dropped from the history")
+	events, err = h.since(11, 1, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{2, 3, 4}, []int{events[0].Seq, events[1].Seq, events[2].Seq})
+	events, err = h.since(11, 3, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []WatchEvent{{Type: "set", Key: "key-4", Index: 11, Seq: 4}}, events)
+}
+
+func TestWatch(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{})
+	applyTestEvent(s, 1, &logEvent{Type: "set", Key: "app/a", Value: "1"})
+	applyTestEvent(s, 2, &logEvent{Type: "set", Key: "other", Value: "2"})
+
+	watcher, err := s.Watch("app/", 1)
+	assert.Nil(t, err)
+	events, err := watcher.Next(nil, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, []WatchEvent{{Type: "set", Key: "app/a", Value: "1", Index: 1}}, events)
+
+	done := make(chan []WatchEvent)
+	go func() {
+		events, _ := watcher.Next(nil, time.Second)
+		done <- events
+	}()
+	applyTestEvent(s, 3, &logEvent{Type: "set", Key: "other", Value: "3"})
+	applyTestEvent(s, 4, &logEvent{Type: "delete", Key: "app/a"})
+	assert.Equal(t, []WatchEvent{{Type: "delete", Key: "app/a", Index: 4}}, <-done)
+	assert.Equal(t, uint64(4), watcher.Index())
+
+	events, err = watcher.Next(nil, time.Millisecond*10)
+	assert.Nil(t, err)
+	assert.Empty(t, events, "Next must return no events when the timeout expires")
+
+	// one log entry changes many keys, events are told apart by Seq
+	applyTestEvent(s, 5, &logEvent{Type: "txn", Txn: &TxnRequest{Success: []TxnOp{
+		{Type: "set", Key: "app/x", Value: "1"},
+		{Type: "set", Key: "other", Value: "2"},
+		{Type: "set", Key: "app/y", Value: "3"},
+	}}})
+	watcher, err = s.Watch("app/", 5)
+	assert.Nil(t, err)
+	events, err = watcher.Next(nil, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, []WatchEvent{
+		{Type: "set", Key: "app/x", Value: "1", Index: 5, Seq: 0},
+		{Type: "set", Key: "app/y", Value: "3", Index: 5, Seq: 2},
+	}, events)
+
+	watcher, err = s.WatchAfter("app/", 5, 0)
+	assert.Nil(t, err)
+	events, err = watcher.Next(nil, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, []WatchEvent{{Type: "set", Key: "app/y", Value: "3", Index: 5, Seq: 2}}, events,
+		"Watch must resume after the received event of the same index")
+
+	watcher, err = s.WatchAfter("app/", 5, 2)
+	assert.Nil(t, err)
+	events, err = watcher.Next(nil, time.Millisecond*10)
+	assert.Nil(t, err)
+	assert.Empty(t, events, "All events of the index are received")
+
+	restored := newTestStorage(map[string]KeyValue{})
+	persistAndRestore(t, raft.NewInmemSnapshotStore(), s, restored)
+	_, err = restored.Watch("app/", 1)
+	assert.Equal(t, ErrCompacted, err)
+	_, err = restored.Watch("app/", 6)
+	assert.Nil(t, err)
+}
+
+func TestWatchAfterCompactedIndex(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{})
+	s.history = newEventHistory(3)
+	applyTestEvent(s, 1, &logEvent{Type: "txn", Txn: &TxnRequest{Success: []TxnOp{
+		{Type: "set", Key: "a", Value: "1"},
+		{Type: "set", Key: "b", Value: "2"},
+		{Type: "set", Key: "c", Value: "3"},
+		{Type: "set", Key: "d", Value: "4"},
+		{Type: "set", Key: "e", Value: "5"},
+	}}})
+
+	_, err := s.WatchAfter("", 1, 0)
+	assert.Equal(t, ErrCompacted, err, "Event 1.1 is dropped from the history")
+
+	watcher, err := s.WatchAfter("", 1, 1)
+	assert.Nil(t, err, "Only the received events of the index are dropped")
+	events, err := watcher.Next(nil, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{2, 3, 4}, []int{events[0].Seq, events[1].Seq, events[2].Seq})
+
+	applyTestEvent(s, 2, &logEvent{Type: "set", Key: "f", Value: "6"})
+	events, err = watcher.Next(nil, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, []WatchEvent{{Type: "set", Key: "f", Value: "6", Index: 2}}, events)
+}
+
+func TestWaitForKeyChange(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{"key": {Value: []byte("1"), ModifyIndex: 1}})
+
+	kv, exists := s.WaitForKeyChange("key", 0, nil, time.Second)
+	assert.True(t, exists)
+	assert.Equal(t, KeyValue{Value: []byte("1"), ModifyIndex: 1}, kv, "Changed key must be returned immediately")
+
+	kv, exists = s.WaitForKeyChange("key", 1, nil, time.Millisecond*10)
+	assert.True(t, exists)
+	assert.Equal(t, uint64(1), kv.ModifyIndex, "Current value must be returned when the timeout expires")
+
+	done := make(chan KeyValue)
+	go func() {
+		kv, _ := s.WaitForKeyChange("key", 1, nil, time.Second)
+		done <- kv
+	}()
+	applyTestEvent(s, 2, &logEvent{Type: "set", Key: "other", Value: "2"})
+	applyTestEvent(s, 3, &logEvent{Type: "set", Key: "key", Value: "3"})
+	assert.Equal(t, KeyValue{Value: []byte("3"), ModifyIndex: 3}, <-done)
+
+	deleted := make(chan bool)
+	go func() {
+		_, exists := s.WaitForKeyChange("key", 3, nil, time.Second)
+		deleted <- !exists
+	}()
+	applyTestEvent(s, 4, &logEvent{Type: "delete", Key: "key"})
+	assert.True(t, <-deleted, "Delete must wake up blocking queries")
+
+	cancel := make(chan struct{})
+	close(cancel)
+	_, exists = s.WaitForKeyChange("key", 0, cancel, time.Second)
+	assert.False(t, exists)
+	assert.Empty(t, s.keyWaiters, "Waiters must be removed when queries return")
+}
+
+func TestKeyExpiry(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{})
+	now := time.Now().UnixNano()
+	second := int64(time.Second)
+
+	applyTestEvent(s, 1, &logEvent{Type: "set", Key: "a", Value: "1", TTL: time.Second, Time: now - 2*second})
+	applyTestEvent(s, 2, &logEvent{Type: "set", Key: "b", Value: "2", TTL: time.Hour, Time: now})
+	applyTestEvent(s, 3, &logEvent{Type: "set", Key: "c", Value: "3", TTL: time.Second, Time: now - 2*second})
+	applyTestEvent(s, 4, &logEvent{Type: "set", Key: "d", Value: "4"})
+
+	_, exists := s.GetKeyValue("a")
+	assert.False(t, exists, "Expired keys must be hidden from reads")
+	kv, _ := s.GetKeyValue("b")
+	assert.Equal(t, KeyValue{Value: []byte("2"), ModifyIndex: 2, ExpiresAt: now + int64(time.Hour)}, kv)
+	pairs, _ := s.List(ListOptions{})
+	assert.Equal(t, []string{"b", "d"}, listKeys(pairs))
+
+	// expired keys don't exist for writes with a later time either
+	response := applyTestEvent(s, 5, &logEvent{Type: "cas", Key: "c", Value: "new", Time: now})
+	assert.Equal(t, casResult{Succeeded: true, Index: 5}, response)
+
+	expired := s.expiredKeys(now, maxExpireBatch)
+	assert.Equal(t, []expiredKey{{Key: "a", Index: 1}}, expired)
+
+	// "a" is changed after the leader found it expired, so it must not be deleted
+	restored := newTestStorage(map[string]KeyValue{})
+	persistAndRestore(t, raft.NewInmemSnapshotStore(), s, restored)
+	applyTestEvent(s, 6, &logEvent{Type: "set", Key: "a", Value: "new", Time: now})
+	assert.Equal(t, expireResult{Deleted: 0, Index: 7}, applyTestEvent(s, 7, &logEvent{Type: "expire", Expired: expired}))
+	_, exists = s.GetKeyValue("a")
+	assert.True(t, exists)
+	assert.Empty(t, s.expiredKeys(now, maxExpireBatch))
+
+	// expiry times and the expiries index are restored from the snapshot
+	assert.Equal(t, expired, restored.expiredKeys(now, maxExpireBatch))
+	assert.Equal(t, expireResult{Deleted: 1, Index: 7}, applyTestEvent(restored, 7, &logEvent{Type: "expire", Expired: expired}))
+	_, exists = restored.lookupKey("a")
+	assert.False(t, exists)
+	assert.Equal(t, []expiredKey{{Key: "b", Index: 2}}, restored.expiredKeys(now+2*int64(time.Hour), maxExpireBatch))
+}
+
+func TestLeases(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{})
+	now := time.Now().UnixNano()
+
+	response := applyTestEvent(s, 1, &logEvent{Type: "lease_grant", TTL: time.Second, Time: now})
+	lease := Lease{ID: 1, TTL: time.Second, ExpiresAt: now + int64(time.Second)}
+	assert.Equal(t, leaseResult{Lease: lease, Index: 1}, response)
+
+	applyTestEvent(s, 2, &logEvent{Type: "set", Key: "a", Value: "1", Lease: 1, Time: now})
+	applyTestEvent(s, 3, &logEvent{Type: "set", Key: "b", Value: "2", Lease: 1, Time: now})
+	applyTestEvent(s, 4, &logEvent{Type: "set", Key: "c", Value: "3", Time: now})
+	assert.Equal(t, ErrLeaseNotFound, applyTestEvent(s, 5, &logEvent{Type: "set", Key: "d", Lease: 100, Time: now}))
+
+	_, keys, exists := s.GetLease(1)
+	assert.True(t, exists)
+	assert.Equal(t, []string{"a", "b"}, keys)
+
+	// keys of an expired lease are hidden until the lease is revoked
+	later := now + int64(time.Second)*2
+	s.mutex.RLock()
+	_, exists = s.getKey("a", later)
+	s.mutex.RUnlock()
+	assert.False(t, exists)
+	assert.Equal(t, []uint64{1}, s.expiredLeases(later))
+	assert.Equal(t, ErrLeaseNotFound, applyTestEvent(s, 6, &logEvent{Type: "lease_keepalive", Lease: 1, Time: later}))
+
+	// the lease is kept alive before the leader's "lease_expire" is applied
+	response = applyTestEvent(s, 7, &logEvent{Type: "lease_keepalive", Lease: 1, Time: now})
+	assert.Equal(t, now+int64(time.Second), response.(leaseResult).Lease.ExpiresAt)
+	response = applyTestEvent(s, 8, &logEvent{Type: "lease_expire", Lease: 1, Time: now})
+	assert.Equal(t, 0, response.(leaseResult).Deleted, "Lease which isn't expired must not be revoked")
+
+	restored := newTestStorage(map[string]KeyValue{})
+	persistAndRestore(t, raft.NewInmemSnapshotStore(), s, restored)
+	restoredLease, keys, exists := restored.GetLease(1)
+	assert.True(t, exists, "Leases must be restored from the snapshot")
+	assert.Equal(t, lease, restoredLease)
+	assert.Equal(t, []string{"a", "b"}, keys)
+
+	for _, storage := range []*RStorage{s, restored} {
+		response = applyTestEvent(storage, 9, &logEvent{Type: "lease_revoke", Lease: 1, Time: now})
+		assert.Equal(t, leaseResult{Deleted: 2, Index: 9}, response)
+		pairs, _ := storage.List(ListOptions{})
+		assert.Equal(t, []string{"c"}, listKeys(pairs), "Keys attached to the lease must be deleted")
+		assert.Equal(t, ErrLeaseNotFound, applyTestEvent(storage, 10, &logEvent{Type: "lease_revoke", Lease: 1}))
+	}
+}
+
+func TestApplyIncrement(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{"_counters/text": {Value: []byte("text"), ModifyIndex: 1}})
+
+	assert.Equal(t, counterResult{Value: 1, Index: 2}, applyTestEvent(s, 2, &logEvent{Type: "incr", Key: "_counters/ids", Delta: 1}))
+	assert.Equal(t, counterResult{Value: 101, Index: 3}, applyTestEvent(s, 3, &logEvent{Type: "incr", Key: "_counters/ids", Delta: 100}))
+	assert.Equal(t, counterResult{Value: 96, Index: 4}, applyTestEvent(s, 4, &logEvent{Type: "incr", Key: "_counters/ids", Delta: -5}))
+	value, err := s.GetCounter("ids")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(96), value)
+
+	assert.Equal(t, ErrCounterOverflow, applyTestEvent(s, 5, &logEvent{Type: "incr", Key: "_counters/ids", Delta: math.MaxInt64}))
+	assert.Equal(t, ErrNotCounter, applyTestEvent(s, 6, &logEvent{Type: "incr", Key: "_counters/text", Delta: 1}))
+	value, _ = s.GetCounter("ids")
+	assert.Equal(t, int64(96), value, "Failed increment must not change the counter")
+
+	for _, by := range []int64{0, -5} {
+		_, _, err = s.Increment("ids", by)
+		assert.Equal(t, ErrInvalidDelta, err, "Counters can't be incremented by %d", by)
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{})
+	binary := []byte{0, 0xff, 0xfe, '\n', 0x80}
+
+	// log entries written before binary values have a string "Value"
+	s.Apply(&raft.Log{Index: 1, Data: []byte(`{"Type":"set","Key":"legacy","Value":"text"}`)})
+	applyTestEvent(s, 2, &logEvent{Type: "set", Key: "binary", Data: binary, ContentType: "image/png"})
+
+	kv, _ := s.GetKeyValue("legacy")
+	assert.Equal(t, KeyValue{Value: []byte("text"), ModifyIndex: 1}, kv)
+	kv, _ = s.GetKeyValue("binary")
+	assert.Equal(t, KeyValue{Value: binary, ContentType: "image/png", ModifyIndex: 2}, kv)
+
+	restored := newTestStorage(map[string]KeyValue{})
+	persistAndRestore(t, raft.NewInmemSnapshotStore(), s, restored)
+	assert.Equal(t, storageMap(s.storage), storageMap(restored.storage), "Binary values must be restored from the snapshot")
+
+	watcher, _ := s.Watch("binary", 1)
+	events, _ := watcher.Next(nil, time.Second)
+	assert.Equal(t, []WatchEvent{{Type: "set", Key: "binary", Data: binary, ContentType: "image/png", Index: 2}}, events)
+}
+
+func TestLogEventEncoding(t *testing.T) {
+	event := &logEvent{
+		Type:        "txn",
+		Data:        []byte{0, 0xff, '{'},
+		ContentType: "image/png",
+		TTL:         time.Minute,
+		Delta:       -5,
+		Expired:     []expiredKey{{Key: "a", Index: 3}},
+		Txn:         &TxnRequest{Success: []TxnOp{{Type: "set", Key: "b", Value: "1"}}},
+		Time:        time.Now().UnixNano(),
+	}
+
+	data, err := encodeLogEvent(event)
+	assert.Nil(t, err)
+	assert.Equal(t, logFormatMsgpack, data[0], "Encoded event must start with the format byte")
+	decoded, err := decodeLogEvent(data)
+	assert.Nil(t, err)
+	assert.Equal(t, event, decoded)
+
+	legacy, _ := json.Marshal(event)
+	decoded, err = decodeLogEvent(legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, event, decoded, "Legacy JSON entries must be decoded")
+
+	_, err = decodeLogEvent([]byte{42, 1, 2})
+	assert.NotNil(t, err)
+	_, err = decodeLogEvent(nil)
+	assert.NotNil(t, err)
+}
+
+func TestApplyBatch(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{"b": {Value: []byte("old"), ModifyIndex: 1}})
+
+	response := applyTestEvent(s, 2, &logEvent{Type: "batch", Batch: []*logEvent{
+		{Type: "set", Key: "a", Data: []byte("1")},
+		{Type: "cas", Key: "b", Data: []byte("new"), PrevIndex: 5},
+		{Type: "delete", Key: "b"},
+		{Type: "incr", Key: "c", Delta: 3},
+	}})
+	assert.Equal(t, []interface{}{
+		uint64(2),
+		casResult{Succeeded: false, Index: 1},
+		deleteResult{Deleted: true, Index: 2},
+		counterResult{Value: 3, Index: 2},
+	}, response, "Every event of the batch must get its own result")
+	assert.Equal(t, uint64(2), s.AppliedIndex())
+
+	kv, _ := s.GetKeyValue("a")
+	assert.Equal(t, uint64(2), kv.ModifyIndex)
+	_, exists := s.GetKeyValue("b")
+	assert.False(t, exists)
+}
+
+func TestCollectBatch(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{})
+	s.config.MaxBatchSize = 3
+	s.batchCh = make(chan *pendingEvent, 10)
+	pending := func(key string, size int) *pendingEvent {
+		return &pendingEvent{event: &logEvent{Type: "set", Key: key, Data: make([]byte, size)}}
+	}
+
+	for _, key := range []string{"b", "c", "d", "e"} {
+		s.batchCh <- pending(key, 1)
+	}
+	batch, next := s.collectBatch(pending("a", 1))
+	assert.Len(t, batch, 3, "Batch must be limited by MaxBatchSize")
+	assert.Nil(t, next)
+
+	batch, next = s.collectBatch(<-s.batchCh)
+	assert.Len(t, batch, 2, "Batch must contain only waiting writes")
+	assert.Nil(t, next)
+
+	s.batchCh <- pending("a", 1)
+	batch, next = s.collectBatch(pending("a", 1))
+	assert.Len(t, batch, 1, "A key can be written only once in a batch")
+	assert.Equal(t, "a", next.event.Key)
+
+	s.batchCh <- pending("b", maxBatchBytes)
+	batch, next = s.collectBatch(pending("a", 1))
+	assert.Len(t, batch, 1, "Batch must be limited by size")
+	assert.Equal(t, "b", next.event.Key)
+
+	s.config.BatchLinger = time.Millisecond * 50
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		s.batchCh <- pending("b", 1)
+	}()
+	batch, _ = s.collectBatch(pending("a", 1))
+	assert.Len(t, batch, 2, "Batch must wait for writes during BatchLinger")
+}
+
+func TestSplitBulk(t *testing.T) {
+	events := func(keys ...string) []*logEvent {
+		var result []*logEvent
+		for _, key := range keys {
+			result = append(result, &logEvent{Type: "set", Key: key})
+		}
+		return result
+	}
+	sizes := func(chunks [][]*logEvent) []int {
+		var result []int
+		for _, chunk := range chunks {
+			result = append(result, len(chunk))
+		}
+		return result
+	}
+
+	assert.Equal(t, []int{2, 2}, sizes(splitBulk(events("a", "b", "a", "c"), false)), "A key can be written only once in an entry")
+	assert.Equal(t, []int{4}, sizes(splitBulk(events("a", "b", "a", "c"), true)), "Atomic writes must not be split by keys")
+
+	many := make([]string, maxBulkEntryOps+1)
+	for i := range many {
+		many[i] = fmt.Sprintf("key-%d", i)
+	}
+	assert.Equal(t, []int{maxBulkEntryOps, 1}, sizes(splitBulk(events(many...), false)))
+	assert.Equal(t, []int{maxBulkEntryOps, 1}, sizes(splitBulk(events(many...), true)))
+
+	big := events("a", "b")
+	big[0].Data = make([]byte, maxBatchBytes)
+	assert.Equal(t, []int{1, 1}, sizes(splitBulk(big, false)), "Entries must be limited by size")
+}
+
+func TestApplyAtomicBatch(t *testing.T) {
+	s := newTestStorage(map[string]KeyValue{"a": {Value: []byte("old"), ModifyIndex: 1}})
+
+	response := applyTestEvent(s, 2, &logEvent{Type: "batch", Atomic: true, Batch: []*logEvent{
+		{Type: "delete", Key: "a"},
+		{Type: "set", Key: "b", Data: []byte("1"), Lease: 10},
+	}})
+	assert.Equal(t, []interface{}{ErrBulkAborted, ErrLeaseNotFound}, response)
+	kv, exists := s.GetKeyValue("a")
+	assert.True(t, exists, "Nothing must be applied if an event of an atomic batch fails")
+	assert.Equal(t, uint64(1), kv.ModifyIndex)
+
+	applyTestEvent(s, 3, &logEvent{Type: "lease_grant", TTL: time.Minute, Time: time.Now().UnixNano()})
+	response = applyTestEvent(s, 4, &logEvent{Type: "batch", Atomic: true, Time: time.Now().UnixNano(), Batch: []*logEvent{
+		{Type: "delete", Key: "a", Time: time.Now().UnixNano()},
+		{Type: "set", Key: "b", Data: []byte("1"), Lease: 3, Time: time.Now().UnixNano()},
+	}})
+	assert.Equal(t, []interface{}{deleteResult{Deleted: true, Index: 4}, uint64(4)}, response)
+}
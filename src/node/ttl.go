@@ -0,0 +1,147 @@
+package node
+
+import (
+	"encoding/binary"
+	"log"
+	"time"
+
+	"github.com/hashicorp/go-immutable-radix"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// expireInterval is how often the leader looks for expired keys
+	expireInterval = time.Second
+	// maxExpireBatch limits the number of keys deleted by one "expire" log entry
+	maxExpireBatch = 128
+)
+
+// expiredKey is a key deleted by an "expire" event,
+// Index protects from deleting the key if it was changed after the leader found it expired
+type expiredKey struct {
+	Key   string
+	Index uint64
+}
+
+// expireResult is returned by Apply for "expire" events
+type expireResult struct {
+	Deleted int
+	Index   uint64
+}
+
+// newKeyValue returns a value written by a "set" or "cas" event with the log entry index
+func newKeyValue(event *logEvent, index uint64) KeyValue {
+	kv := KeyValue{
+		Value:       event.value(),
+		ContentType: event.ContentType,
+		ModifyIndex: index,
+		Lease:       event.Lease,
+	}
+	if event.TTL > 0 {
+		kv.ExpiresAt = event.Time + int64(event.TTL)
+	}
+	return kv
+}
+
+// keyExpired reports whether the key is expired at the time now (Unix nanoseconds)
+// either by its own TTL or by the lease it is attached to
+func keyExpired(kv KeyValue, leases *iradix.Tree, now int64) bool {
+	if kv.ExpiresAt != 0 && kv.ExpiresAt <= now {
+		return true
+	}
+	if kv.Lease != 0 {
+		lease, exists := leases.Get(leaseIndexKey(kv.Lease))
+		return !exists || lease.(Lease).expired(now)
+	}
+	return false
+}
+
+// expiryIndexKey returns a key of the expiries tree: big-endian expiry time followed by the key,
+// so walking the tree returns keys in the order they expire
+func expiryIndexKey(key string, expiresAt int64) []byte {
+	indexKey := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(indexKey, uint64(expiresAt))
+	return append(indexKey, key...)
+}
+
+// addExpiry adds the key to the expiries index if it has TTL, s.mutex must be held
+func (s *RStorage) addExpiry(key string, kv KeyValue) {
+	if kv.ExpiresAt != 0 {
+		s.expiries, _, _ = s.expiries.Insert(expiryIndexKey(key, kv.ExpiresAt), nil)
+	}
+}
+
+// removeExpiry removes the key from the expiries index, s.mutex must be held
+func (s *RStorage) removeExpiry(key string, kv KeyValue) {
+	if kv.ExpiresAt != 0 {
+		s.expiries, _, _ = s.expiries.Delete(expiryIndexKey(key, kv.ExpiresAt))
+	}
+}
+
+// expiredKeys returns up to limit keys expired at the time now
+func (s *RStorage) expiredKeys(now int64, limit int) []expiredKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var keys []expiredKey
+	s.expiries.Root().Walk(func(indexKey []byte, _ interface{}) bool {
+		if int64(binary.BigEndian.Uint64(indexKey[:8])) > now || len(keys) == limit {
+			return true
+		}
+		key := string(indexKey[8:])
+		kv, _ := s.lookupKey(key)
+		keys = append(keys, expiredKey{Key: key, Index: kv.ModifyIndex})
+		return false
+	})
+	return keys
+}
+
+// applyExpire is called by Apply for "expire" events, s.mutex must be held.
+// It doesn't check the expiry time itself, the leader has already done it
+func (s *RStorage) applyExpire(index uint64, keys []expiredKey) expireResult {
+	result := expireResult{Index: index}
+	for _, expired := range keys {
+		kv, exists := s.lookupKey(expired.Key)
+		if !exists || kv.ModifyIndex != expired.Index {
+			continue
+		}
+		s.deleteKey(expired.Key, index)
+		result.Deleted++
+	}
+	return result
+}
+
+// runExpiry deletes expired keys and leases while the node is the leader,
+// deletes go through the Raft log, so all replicas delete keys at the same index.
+// Until then expired keys are hidden from reads
+func (s *RStorage) runExpiry() {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		switch s.RaftNode.State() {
+		case raft.Shutdown:
+			return
+		case raft.Leader:
+		default:
+			continue
+		}
+
+		now := time.Now().UnixNano()
+		for _, id := range s.expiredLeases(now) {
+			log.Printf("[DEBUG] Revoking expired lease %d", id)
+			if _, err := s.applyEvent(&logEvent{Type: "lease_expire", Lease: id}); err != nil {
+				log.Printf("[ERROR] Can't revoke expired lease %d: %+v", id, err)
+			}
+		}
+
+		keys := s.expiredKeys(now, maxExpireBatch)
+		if len(keys) == 0 {
+			continue
+		}
+		log.Printf("[DEBUG] Deleting %d expired keys", len(keys))
+		if _, err := s.applyEvent(&logEvent{Type: "expire", Expired: keys}); err != nil {
+			log.Printf("[ERROR] Can't delete expired keys: %+v", err)
+		}
+	}
+}
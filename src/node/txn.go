@@ -0,0 +1,209 @@
+package node
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxTxnOps limits the number of compares and operations in one transaction
+const maxTxnOps = 128
+
+// TxnCompare is a condition of a transaction
+type TxnCompare struct {
+	Key string `json:"key"`
+	// Target is what is compared: "value", "revision" or "exists"
+	Target string `json:"target"`
+	// Op is a comparison operator: "=" (default), "!=", "<" or ">",
+	// "exists" supports only "=" and "!="
+	Op       string `json:"op,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Revision uint64 `json:"revision,omitempty"`
+	Exists   bool   `json:"exists,omitempty"`
+}
+
+// TxnOp is an operation of a transaction
+type TxnOp struct {
+	// Type is "set", "delete" or "get"
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// TxnRequest is a list of compares and two branches of operations:
+// if all compares succeed, Success operations are applied, otherwise Failure operations
+type TxnRequest struct {
+	Compare []TxnCompare `json:"compare"`
+	Success []TxnOp      `json:"success"`
+	Failure []TxnOp      `json:"failure"`
+}
+
+// TxnOpResult is a result of one transaction operation
+type TxnOpResult struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	// Value is the value of the key for "get" operations,
+	// Data and ContentType are set instead for raw values, see KeyValue.ContentType
+	Value       string `json:"value,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	// Exists reports whether the key existed for "get" and "delete" operations
+	Exists bool `json:"exists"`
+	// Revision is the revision of the key after the operation, 0 if it doesn't exist
+	Revision uint64 `json:"revision"`
+}
+
+// TxnResponse is the result of a transaction
+type TxnResponse struct {
+	// Succeeded reports whether all compares succeeded and Success branch was applied
+	Succeeded bool          `json:"succeeded"`
+	Index     uint64        `json:"index"`
+	Results   []TxnOpResult `json:"results"`
+}
+
+// Validate checks that the transaction is well-formed
+func (txn *TxnRequest) Validate() error {
+	if len(txn.Compare)+len(txn.Success)+len(txn.Failure) > maxTxnOps {
+		return fmt.Errorf("Transaction can't contain more than %d compares and operations", maxTxnOps)
+	}
+
+	for i, cmp := range txn.Compare {
+		if cmp.Key == "" {
+			return fmt.Errorf("compare %d: key is required", i)
+		}
+		switch cmp.Op {
+		case "", "=", "!=":
+		case "<", ">":
+			if cmp.Target == "exists" {
+				return fmt.Errorf("compare %d: \"exists\" supports only \"=\" and \"!=\"", i)
+			}
+		default:
+			return fmt.Errorf("compare %d: unknown op: %s", i, cmp.Op)
+		}
+		switch cmp.Target {
+		case "value", "revision", "exists":
+		default:
+			return fmt.Errorf("compare %d: unknown target: %s", i, cmp.Target)
+		}
+	}
+
+	for _, ops := range [][]TxnOp{txn.Success, txn.Failure} {
+		for i, op := range ops {
+			if op.Key == "" {
+				return fmt.Errorf("operation %d: key is required", i)
+			}
+			switch op.Type {
+			case "set", "delete", "get":
+			default:
+				return fmt.Errorf("operation %d: unknown type: %s", i, op.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// Txn applies the transaction atomically, in one Raft log entry
+func (s *RStorage) Txn(txn *TxnRequest) (*TxnResponse, error) {
+	if err := txn.Validate(); err != nil {
+		return nil, err
+	}
+
+	response, err := s.applyEvent(&logEvent{
+		Type: "txn",
+		Txn:  txn,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result, ok := response.(*TxnResponse)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected FSM response: %+v", response)
+	}
+	return result, nil
+}
+
+// applyTxn is called by Apply for "txn" events, s.mutex must be held
+// now is the time of the event, keys expired at this time are treated as missing
+func (s *RStorage) applyTxn(index uint64, now int64, txn *TxnRequest) *TxnResponse {
+	succeeded := true
+	for _, cmp := range txn.Compare {
+		if !s.compare(cmp, now) {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := txn.Success
+	if !succeeded {
+		ops = txn.Failure
+	}
+
+	results := make([]TxnOpResult, 0, len(ops))
+	for _, op := range ops {
+		result := TxnOpResult{Type: op.Type, Key: op.Key}
+		switch op.Type {
+		case "set":
+			s.putKey(op.Key, KeyValue{Value: []byte(op.Value), ModifyIndex: index})
+			result.Exists = true
+			result.Revision = index
+		case "delete":
+			_, result.Exists = s.getKey(op.Key, now)
+			s.deleteKey(op.Key, index)
+		case "get":
+			kv, exists := s.getKey(op.Key, now)
+			if kv.ContentType != "" {
+				result.Data = kv.Value
+				result.ContentType = kv.ContentType
+			} else {
+				result.Value = string(kv.Value)
+			}
+			result.Exists = exists
+			result.Revision = kv.ModifyIndex
+		}
+		results = append(results, result)
+	}
+
+	return &TxnResponse{Succeeded: succeeded, Index: index, Results: results}
+}
+
+// compare checks one transaction condition, s.mutex must be held.
+// Missing keys have revision 0, and all value comparisons fail for them
+func (s *RStorage) compare(cmp TxnCompare, now int64) bool {
+	kv, exists := s.getKey(cmp.Key, now)
+
+	var result int
+	switch cmp.Target {
+	case "exists":
+		if exists == cmp.Exists {
+			result = 0
+		} else {
+			result = 1
+		}
+	case "revision":
+		result = compareUint64(kv.ModifyIndex, cmp.Revision)
+	case "value":
+		if !exists {
+			return false
+		}
+		result = strings.Compare(string(kv.Value), cmp.Value)
+	}
+
+	switch cmp.Op {
+	case "!=":
+		return result != 0
+	case "<":
+		return result < 0
+	case ">":
+		return result > 0
+	}
+	return result == 0
+}
+
+func compareUint64(a, b uint64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,213 @@
+package node
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// watchHistorySize is how many recent events are kept in memory for watchers
+const watchHistorySize = 1000
+
+// ErrCompacted is returned when the requested events are not in the history anymore,
+// the client must re-list keys and start watching from the current index
+var ErrCompacted = errors.New("Requested index is compacted, re-list keys and watch from the current index")
+
+// WatchEvent is a change of a key
+type WatchEvent struct {
+	// Type is "set" or "delete"
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	// Value is set for string values, Data and ContentType for raw values
+	Value       string `json:"value,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	// Index of the Raft log entry which made the change
+	Index uint64 `json:"index"`
+	// Seq is the number of the event among events of the same index, starting from 0,
+	// one log entry changes many keys with transactions, batches and expiry.
+	// Index and Seq together identify the event, see WatchAfter
+	Seq int `json:"seq"`
+}
+
+// eventHistory is a ring buffer of the recent events ordered by index
+type eventHistory struct {
+	events []WatchEvent
+	start  int
+	size   int
+	// compactedIndex is the highest index which events may be missing from the history
+	compactedIndex uint64
+	// lastIndex and lastSeq identify the last added event, even if it is already dropped
+	lastIndex uint64
+	lastSeq   int
+}
+
+// newSetEvent returns an event for the key written with kv
+func newSetEvent(key string, kv KeyValue) WatchEvent {
+	event := WatchEvent{Type: "set", Key: key, Index: kv.ModifyIndex}
+	if kv.ContentType != "" {
+		event.Data = kv.Value
+		event.ContentType = kv.ContentType
+	} else {
+		event.Value = string(kv.Value)
+	}
+	return event
+}
+
+func newEventHistory(capacity int) *eventHistory {
+	return &eventHistory{events: make([]WatchEvent, capacity)}
+}
+
+// add appends an event and sets its Seq, the oldest event is dropped if the history is full
+func (h *eventHistory) add(event WatchEvent) {
+	event.Seq = 0
+	if event.Index == h.lastIndex {
+		event.Seq = h.lastSeq + 1
+	}
+	h.lastIndex, h.lastSeq = event.Index, event.Seq
+
+	if h.size == len(h.events) {
+		h.compactedIndex = h.events[h.start].Index
+		h.start = (h.start + 1) % len(h.events)
+		h.size--
+	}
+	h.events[(h.start+h.size)%len(h.events)] = event
+	h.size++
+}
+
+// reset drops all events, it is used when the storage is restored from a snapshot
+func (h *eventHistory) reset(compactedIndex uint64) {
+	h.start = 0
+	h.size = 0
+	h.compactedIndex = compactedIndex
+	h.lastIndex = compactedIndex
+	h.lastSeq = 0
+}
+
+// since returns events after the event with the index and seq for keys with the prefix,
+// seq -1 means that all events of the index are returned.
+// Returns ErrCompacted if some of these events are already dropped
+func (h *eventHistory) since(index uint64, seq int, prefix string) ([]WatchEvent, error) {
+	if h.compacted(index, seq) {
+		return nil, ErrCompacted
+	}
+
+	var events []WatchEvent
+	for i := 0; i < h.size; i++ {
+		event := h.events[(h.start+i)%len(h.events)]
+		if event.Index < index || event.Index == index && event.Seq <= seq {
+			continue
+		}
+		if strings.HasPrefix(event.Key, prefix) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// compacted returns true if some events after the event with the index and seq are dropped
+func (h *eventHistory) compacted(index uint64, seq int) bool {
+	if index != h.compactedIndex {
+		return index < h.compactedIndex
+	}
+	// the first events of the index are dropped, the rest are still there
+	// if the oldest one of them is the next after seq
+	for i := 0; i < h.size; i++ {
+		event := h.events[(h.start+i)%len(h.events)]
+		if event.Index == index {
+			return event.Seq > seq+1
+		}
+	}
+	return true
+}
+
+// Watcher returns changes of keys with a prefix in the order they are applied
+type Watcher struct {
+	storage   *RStorage
+	prefix    string
+	lastIndex uint64
+	// events of afterIndex with Seq up to afterSeq are already received, see WatchAfter
+	afterIndex uint64
+	afterSeq   int
+}
+
+// Watch starts watching keys with the prefix.
+// If fromIndex is 0, only new changes are returned,
+// otherwise the watcher starts from the events with index >= fromIndex
+func (s *RStorage) Watch(prefix string, fromIndex uint64) (*Watcher, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	lastIndex := s.appliedIndex
+	if fromIndex > 0 {
+		lastIndex = fromIndex - 1
+		if s.history.compacted(fromIndex, -1) {
+			return nil, ErrCompacted
+		}
+	}
+	return &Watcher{storage: s, prefix: prefix, lastIndex: lastIndex}, nil
+}
+
+// WatchAfter starts watching keys with the prefix after the event with the index and seq,
+// so a client which received the event resumes without losing the other events of the same index
+func (s *RStorage) WatchAfter(prefix string, index uint64, seq int) (*Watcher, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// the older events of the index may be dropped already, they are received by the client
+	if s.history.compacted(index, seq) {
+		return nil, ErrCompacted
+	}
+	return &Watcher{storage: s, prefix: prefix, lastIndex: index - 1, afterIndex: index, afterSeq: seq}, nil
+}
+
+// Next blocks until there are new events, timeout expires or cancel is closed.
+// It returns no events if the timeout expired or the watch is cancelled
+func (w *Watcher) Next(cancel <-chan struct{}, timeout time.Duration) ([]WatchEvent, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		index, seq := w.position()
+		w.storage.mutex.RLock()
+		events, err := w.storage.history.since(index, seq, w.prefix)
+		appliedIndex, appliedCh := w.storage.appliedIndex, w.storage.appliedCh
+		w.storage.mutex.RUnlock()
+
+		if err != nil {
+			return nil, err
+		}
+		if appliedIndex > w.lastIndex {
+			w.lastIndex = appliedIndex
+		}
+		if w.lastIndex >= w.afterIndex {
+			// all events of afterIndex are seen now
+			w.afterIndex = 0
+		}
+		if len(events) > 0 {
+			return events, nil
+		}
+
+		select {
+		case <-appliedCh:
+		case <-timer.C:
+			return nil, nil
+		case <-cancel:
+			return nil, nil
+		}
+	}
+}
+
+// position returns the index and seq of the last event received by the watcher,
+// seq -1 means that no events of the index are received
+func (w *Watcher) position() (uint64, int) {
+	if w.afterIndex != 0 {
+		return w.afterIndex, w.afterSeq
+	}
+	return w.lastIndex + 1, -1
+}
+
+// Index returns the index the watcher has seen all events up to
+func (w *Watcher) Index() uint64 {
+	return w.lastIndex
+}
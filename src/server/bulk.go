@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/alexander-akhmetov/raft-example/src/node"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// bulkKey is the key in the path of the bulk endpoint: POST /keys/_bulk/,
+	// it isn't a separate route because the router doesn't allow it next to /keys/:key/
+	bulkKey = "_bulk"
+	// maxBulkItems limits the number of operations in one bulk request
+	maxBulkItems = 10000
+	// maxBulkSize limits the size of a bulk request body
+	maxBulkSize = 32 * 1024 * 1024
+)
+
+// bulkItem is an operation of a bulk request
+type bulkItem struct {
+	// Op is "set" or "delete"
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	TTL   string `json:"ttl"`
+	Lease uint64 `json:"lease"`
+}
+
+// postKeyView handles POST /keys/<key>/, the bulk endpoint shares the route with it
+func postKeyView(storage *node.RStorage) func(*gin.Context) {
+	setKey := setKeyView(storage)
+	bulk := bulkView(storage)
+	view := func(c *gin.Context) {
+		if c.Param("key") == bulkKey {
+			bulk(c)
+			return
+		}
+		setKey(c)
+	}
+	return view
+}
+
+// bulkView applies many set and delete operations at once:
+// POST /keys/_bulk/?atomic=true
+// the body is a JSON array or newline delimited JSON objects, see bulkItem
+func bulkView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		atomic := false
+		if param := c.Query("atomic"); param != "" {
+			var err error
+			atomic, err = strconv.ParseBool(param)
+			if err != nil {
+				badRequestResponse(c, "invalid_request", fmt.Errorf("Invalid atomic parameter: %s", param))
+				return
+			}
+		}
+
+		items, ok := readBulkItems(c)
+		if !ok {
+			return
+		}
+		ops := make([]node.BulkOp, len(items))
+		for i, item := range items {
+			op, err := item.bulkOp()
+			if err != nil {
+				badRequestResponse(c, "invalid_bulk", fmt.Errorf("operation %d: %v", i, err))
+				return
+			}
+			ops[i] = op
+		}
+
+		results, err := storage.Bulk(ops, atomic)
+		if err != nil {
+			errorResponse(c, err)
+			return
+		}
+
+		var index uint64
+		failed := false
+		response := make([]gin.H, len(results))
+		for i, result := range results {
+			item := gin.H{"op": items[i].Op, "key": items[i].Key}
+			if result.Err != nil {
+				_, code := errorStatus(result.Err)
+				item["code"] = code
+				item["error"] = fmt.Sprintf("%+v", result.Err)
+				failed = true
+			} else {
+				item["index"] = result.Index
+				if items[i].Op == "delete" {
+					item["deleted"] = result.Deleted
+				}
+				if result.Index > index {
+					index = result.Index
+				}
+			}
+			response[i] = item
+		}
+		writeResponse(c, index, gin.H{
+			"errors":  failed,
+			"results": response,
+		})
+	}
+	return view
+}
+
+// readBulkItems reads operations from the request body
+// returns false if the body is invalid, the error is already written to the response
+func readBulkItems(c *gin.Context) ([]bulkItem, bool) {
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxBulkSize+1))
+	if err != nil {
+		badRequestResponse(c, "invalid_request", err)
+		return nil, false
+	}
+	if len(body) > maxBulkSize {
+		bulkTooLargeResponse(c, fmt.Errorf("Bulk request can't be larger than %d bytes", maxBulkSize))
+		return nil, false
+	}
+
+	var items []bulkItem
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &items)
+	} else {
+		// newline delimited JSON
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		for err == nil {
+			var item bulkItem
+			if err = decoder.Decode(&item); err == nil {
+				items = append(items, item)
+			}
+		}
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		badRequestResponse(c, "invalid_request", fmt.Errorf("Can't parse bulk request: %v", err))
+		return nil, false
+	}
+
+	if len(items) == 0 {
+		badRequestResponse(c, "invalid_bulk", fmt.Errorf("Bulk request has no operations"))
+		return nil, false
+	}
+	if len(items) > maxBulkItems {
+		bulkTooLargeResponse(c, fmt.Errorf("Bulk request can't have more than %d operations", maxBulkItems))
+		return nil, false
+	}
+	return items, true
+}
+
+func bulkTooLargeResponse(c *gin.Context, err error) {
+	c.JSON(413, gin.H{
+		"code":  "bulk_too_large",
+		"error": fmt.Sprintf("%+v", err),
+	})
+}
+
+// bulkOp validates the item and converts it to node.BulkOp
+func (item *bulkItem) bulkOp() (node.BulkOp, error) {
+	op := node.BulkOp{Type: item.Op, Key: item.Key}
+	if item.Key == "" {
+		return op, fmt.Errorf("key is required")
+	}
+
+	switch item.Op {
+	case "delete":
+		if item.Value != "" || item.TTL != "" || item.Lease != 0 {
+			return op, fmt.Errorf("delete can't have value, ttl or lease")
+		}
+	case "set":
+		op.Value = []byte(item.Value)
+		op.Lease = item.Lease
+		if item.TTL != "" {
+			if item.Lease != 0 {
+				return op, fmt.Errorf("a key can't have both ttl and lease")
+			}
+			ttl, err := time.ParseDuration(item.TTL)
+			if err != nil || ttl <= 0 {
+				return op, fmt.Errorf("invalid ttl: %s", item.TTL)
+			}
+			op.TTL = ttl
+		}
+	default:
+		return op, fmt.Errorf("unknown operation: %s", item.Op)
+	}
+	return op, nil
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alexander-akhmetov/raft-example/src/node"
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// defaultPromotionWait is how long promotion waits for a non-voter to catch up by default
+	defaultPromotionWait = time.Minute
+	// defaultMaxPromotionLag is how many log entries a non-voter can be behind the leader to be promoted
+	defaultMaxPromotionLag = 100
+	// statusTimeout limits requests to other nodes for their status
+	statusTimeout = time.Second * 2
+)
+
+// removeServerView removes a server from the cluster:
+// DELETE /cluster/servers/<id>/
+func removeServerView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		id := c.Param("id")
+		index, err := storage.RemoveServer(id)
+		if err != nil {
+			errorResponse(c, err)
+			return
+		}
+		writeResponse(c, index, gin.H{
+			"id": id,
+		})
+	}
+	return view
+}
+
+// nodeStatus is the status of a node returned by localStatusView
+type nodeStatus struct {
+	ID           string            `json:"id"`
+	State        string            `json:"state"`
+	AppliedIndex uint64            `json:"applied_index"`
+	Stats        map[string]string `json:"stats"`
+}
+
+// localStatusView returns the status of this node:
+// GET /cluster/local/
+func localStatusView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		c.JSON(200, localNodeStatus(storage))
+	}
+	return view
+}
+
+func localNodeStatus(storage *node.RStorage) nodeStatus {
+	return nodeStatus{
+		ID:           storage.NodeID(),
+		State:        storage.RaftNode.State().String(),
+		AppliedIndex: storage.AppliedIndex(),
+		Stats:        storage.RaftNode.Stats(),
+	}
+}
+
+// serverStatus is a server of the cluster returned by clusterStatusView
+type serverStatus struct {
+	ID          string `json:"id"`
+	Address     string `json:"address"`
+	HTTPAddress string `json:"http_address"`
+	Suffrage    string `json:"suffrage"`
+	Leader      bool   `json:"leader"`
+	// State, AppliedIndex and Stats are reported by the server itself,
+	// Error is set instead if it doesn't respond
+	State        string            `json:"state,omitempty"`
+	AppliedIndex uint64            `json:"applied_index,omitempty"`
+	Stats        map[string]string `json:"stats,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// clusterStatusView returns all servers of the cluster with their status,
+// other nodes are asked for their status in parallel:
+// GET /cluster/
+func clusterStatusView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		servers, err := storage.GetClusterServers()
+		if err != nil {
+			errorResponse(c, err)
+			return
+		}
+
+		leader := storage.RaftNode.Leader()
+		leaderID := ""
+		statuses := make([]serverStatus, len(servers))
+		var wg sync.WaitGroup
+		for i, server := range servers {
+			status := &statuses[i]
+			status.ID = string(server.ID)
+			status.Address = string(server.Address)
+			status.Suffrage = server.Suffrage.String()
+			status.Leader = server.Address == leader
+			if status.Leader {
+				leaderID = status.ID
+			}
+			httpAddress, err := serverHTTPAddress(storage, server)
+			status.HTTPAddress = httpAddress
+			if status.ID == storage.NodeID() {
+				status.setNodeStatus(localNodeStatus(storage), nil)
+				continue
+			}
+			if err != nil {
+				status.setNodeStatus(nodeStatus{}, err)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				status.setNodeStatus(fetchNodeStatus(c.Request.Context(), status.HTTPAddress))
+			}()
+		}
+		wg.Wait()
+
+		c.JSON(200, gin.H{
+			"leader":  leaderID,
+			"servers": statuses,
+		})
+	}
+	return view
+}
+
+func (status *serverStatus) setNodeStatus(nodeStatus nodeStatus, err error) {
+	if err != nil {
+		status.Error = fmt.Sprintf("%+v", err)
+		return
+	}
+	status.State = nodeStatus.State
+	status.AppliedIndex = nodeStatus.AppliedIndex
+	status.Stats = nodeStatus.Stats
+}
+
+// fetchNodeStatus requests the status of another node by its HTTP address
+func fetchNodeStatus(ctx context.Context, httpAddress string) (nodeStatus, error) {
+	var status nodeStatus
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/cluster/local/", httpAddress), nil)
+	if err != nil {
+		return status, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, statusTimeout)
+	defer cancel()
+
+	resp, err := forwardClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return status, fmt.Errorf("Status code is not 200: %v", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
+
+// promoteServerView makes a non-voter a voter when it catches up with the leader:
+// POST /cluster/servers/<id>/promote/?max_lag=100&wait=1m
+func promoteServerView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		id := c.Param("id")
+		maxLag := uint64(defaultMaxPromotionLag)
+		if value := c.Query("max_lag"); value != "" {
+			var err error
+			maxLag, err = strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				badRequestResponse(c, "invalid_lag", fmt.Errorf("Invalid max_lag: %s", value))
+				return
+			}
+		}
+		wait := defaultPromotionWait
+		if value := c.Query("wait"); value != "" {
+			var err error
+			wait, err = time.ParseDuration(value)
+			if err != nil || wait <= 0 {
+				badRequestResponse(c, "invalid_wait", fmt.Errorf("Invalid wait: %s", value))
+				return
+			}
+			if wait > maxBlockingWait {
+				wait = maxBlockingWait
+			}
+		}
+
+		appliedIndex := func(server raft.Server) (uint64, error) {
+			httpAddress, err := serverHTTPAddress(storage, server)
+			if err != nil {
+				return 0, err
+			}
+			status, err := fetchNodeStatus(c.Request.Context(), httpAddress)
+			return status.AppliedIndex, err
+		}
+		index, err := storage.PromoteNonvoter(id, maxLag, appliedIndex, c.Request.Context().Done(), wait)
+		if err != nil {
+			errorResponse(c, err)
+			return
+		}
+		writeResponse(c, index, gin.H{
+			"id": id,
+		})
+	}
+	return view
+}
+
+// demoteServerView makes a voter a non-voter:
+// POST /cluster/servers/<id>/demote/
+func demoteServerView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		id := c.Param("id")
+		index, err := storage.DemoteVoter(id)
+		if err != nil {
+			errorResponse(c, err)
+			return
+		}
+		writeResponse(c, index, gin.H{
+			"id": id,
+		})
+	}
+	return view
+}
+
+// Leave removes this node from the cluster before it shuts down,
+// the leader removes itself, a follower asks the leader to remove it
+func Leave(storage *node.RStorage) error {
+	if storage.RaftNode.State() == raft.Leader {
+		_, err := storage.RemoveServer(storage.NodeID())
+		return err
+	}
+
+	leader := storage.RaftNode.Leader()
+	if leader == "" {
+		return node.ErrNoLeader
+	}
+	httpAddress, err := leaderHTTPAddress(storage, leader)
+	if err != nil {
+		return err
+	}
+
+	target := url.URL{
+		Scheme:  "http",
+		Host:    httpAddress,
+		Path:    fmt.Sprintf("/cluster/servers/%s/", storage.NodeID()),
+		RawPath: fmt.Sprintf("/cluster/servers/%s/", url.PathEscape(storage.NodeID())),
+	}
+	log.Printf("[INFO] Asking the leader at %s to remove this node from the cluster", httpAddress)
+	req, err := http.NewRequest("DELETE", target.String(), nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	defer cancel()
+
+	resp, err := forwardClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Leader status code is not 200: %v %s", resp.StatusCode, body)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/alexander-akhmetov/raft-example/src/node"
+	"github.com/gin-gonic/gin"
+)
+
+// maxReserveCount limits the size of a range reserved by one request
+const maxReserveCount = 1000000
+
+// incrementCounterView adds "by" (1 by default) to the counter and returns the new value:
+// POST /counters/<name>/incr/?by=10
+func incrementCounterView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		by := int64(1)
+		if value := c.Query("by"); value != "" {
+			var err error
+			by, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || by <= 0 {
+				badRequestResponse(c, "invalid_delta", fmt.Errorf("by must be a positive number, got: %s", value))
+				return
+			}
+		}
+
+		value, index, err := storage.Increment(c.Param("name"), by)
+		if err != nil {
+			errorResponse(c, err)
+			return
+		}
+		writeResponse(c, index, gin.H{"value": value})
+	}
+	return view
+}
+
+// reserveRangeView reserves a block of "count" unique values in one Raft log entry:
+// POST /counters/<name>/reserve/?count=100 returns {"start": 1, "end": 100}
+func reserveRangeView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		value := c.Query("count")
+		count, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || count <= 0 || count > maxReserveCount {
+			badRequestResponse(c, "invalid_count", fmt.Errorf("count must be a number from 1 to %d, got: %s", maxReserveCount, value))
+			return
+		}
+
+		start, end, index, err := storage.ReserveRange(c.Param("name"), count)
+		if err != nil {
+			errorResponse(c, err)
+			return
+		}
+		writeResponse(c, index, gin.H{"start": start, "end": end})
+	}
+	return view
+}
+
+// getCounterView returns the current value of the counter, missing counters are 0
+func getCounterView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		if !prepareRead(c, storage) {
+			return
+		}
+
+		value, err := storage.GetCounter(c.Param("name"))
+		if err != nil {
+			errorResponse(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"value": value})
+	}
+	return view
+}
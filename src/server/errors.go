@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/alexander-akhmetov/raft-example/src/node"
+	"github.com/gin-gonic/gin"
+)
+
+// errorStatus maps errors returned by RStorage to HTTP status codes
+// and machine-readable error codes
+func errorStatus(err error) (int, string) {
+	switch err {
+	case node.ErrNotLeader:
+		return 421, "not_leader"
+	case node.ErrNoLeader:
+		return 503, "no_leader"
+	case node.ErrLeadershipLost:
+		return 503, "leadership_lost"
+	case node.ErrTimeout:
+		return 504, "timeout"
+	case node.ErrShutdown:
+		return 503, "shutdown"
+	case node.ErrStaleRead:
+		return 503, "stale_read"
+	case node.ErrIndexTimeout:
+		return 504, "index_timeout"
+	case node.ErrKeyNotFound:
+		return 404, "key_not_found"
+	case node.ErrKeyExists:
+		return 409, "key_exists"
+	case node.ErrRevisionMismatch:
+		return 412, "revision_mismatch"
+	case node.ErrCompacted:
+		return 410, "compacted"
+	case node.ErrLeaseNotFound:
+		return 404, "lease_not_found"
+	case node.ErrLockHeld:
+		return 409, "lock_held"
+	case node.ErrLockNotHeld:
+		return 409, "lock_not_held"
+	case node.ErrCounterOverflow:
+		return 409, "counter_overflow"
+	case node.ErrNotCounter:
+		return 409, "not_counter"
+	case node.ErrInvalidDelta:
+		return 400, "invalid_delta"
+	case node.ErrBulkAborted:
+		return 409, "aborted"
+	case node.ErrBulkTooLarge:
+		return 413, "bulk_too_large"
+	case node.ErrServerNotFound:
+		return 404, "server_not_found"
+	case node.ErrMinVoters:
+		return 409, "min_voters"
+	case node.ErrCatchUpTimeout:
+		return 504, "catch_up_timeout"
+	case node.ErrAddressInUse:
+		return 409, "address_in_use"
+	}
+
+	if _, ok := err.(*node.FSMError); ok {
+		return 500, "apply_failed"
+	}
+	return 500, "internal_error"
+}
+
+// errorResponse writes an error returned by RStorage to the response
+func errorResponse(c *gin.Context, err error) {
+	status, code := errorStatus(err)
+	c.JSON(status, gin.H{
+		"code":  code,
+		"error": fmt.Sprintf("%+v", err),
+	})
+}
+
+// badRequestResponse is used when the request can't be parsed
+func badRequestResponse(c *gin.Context, code string, err error) {
+	log.Printf("[ERROR] Bad request: %+v", err)
+	c.JSON(400, gin.H{
+		"code":  code,
+		"error": fmt.Sprintf("%+v", err),
+	})
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/alexander-akhmetov/raft-example/src/node"
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// forwardedHopsHeader counts how many times the request was forwarded between nodes
+	forwardedHopsHeader = "X-Raft-Forwarded-Hops"
+	// servedByHeader contains ID of the node which handled the write
+	servedByHeader = "X-Raft-Served-By"
+	// maxForwardHops protects from forwarding loops while the cluster changes its leader
+	maxForwardHops = 3
+	// defaultHTTPPort is the default port nodes listen for HTTP requests on,
+	// it is used for nodes which haven't registered their HTTP addresses
+	defaultHTTPPort = "8080"
+	// blockingRequestKey is set for requests which wait without "?wait" too, see blockingRequest
+	blockingRequestKey = "blocking_request"
+)
+
+// forwardTimeout limits the time of a forwarded request,
+// blocking queries, lock acquisitions and promotions may wait up to maxBlockingWait in addition
+var forwardTimeout = time.Second * 10
+
+var forwardClient = &http.Client{
+	// redirects are relayed to the client as is
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// resolveHTTPAddress guesses HTTP address of a node by its Raft address,
+// it is the host of the Raft address with the default HTTP port.
+// It is used only for nodes which haven't registered their HTTP addresses, see serverHTTPAddress
+var resolveHTTPAddress = func(raftAddress string) (string, error) {
+	host, _, err := net.SplitHostPort(raftAddress)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, defaultHTTPPort), nil
+}
+
+// serverHTTPAddress returns HTTP address of a server of the cluster
+// registered by the node in the FSM, or guessed by its Raft address
+func serverHTTPAddress(storage *node.RStorage, server raft.Server) (string, error) {
+	if httpAddress, exists := storage.NodeHTTPAddress(string(server.ID)); exists {
+		return httpAddress, nil
+	}
+	return resolveHTTPAddress(string(server.Address))
+}
+
+// leaderHTTPAddress returns HTTP address of the leader by its Raft address
+func leaderHTTPAddress(storage *node.RStorage, leader raft.ServerAddress) (string, error) {
+	servers, err := storage.GetClusterServers()
+	if err == nil {
+		for _, server := range servers {
+			if server.Address == leader {
+				return serverHTTPAddress(storage, server)
+			}
+		}
+	}
+	return resolveHTTPAddress(string(leader))
+}
+
+// blockingRequest is a middleware for endpoints which wait by default,
+// so followers forward them with the same timeout as requests with "?wait"
+func blockingRequest(c *gin.Context) {
+	c.Set(blockingRequestKey, true)
+}
+
+// forwardToLeader is a middleware for write requests.
+// The leader handles the request itself, followers forward it to the leader
+// and relay the leader's response back to the client.
+// With "?forward=false" a follower returns 307 redirect to the leader instead.
+func forwardToLeader(storage *node.RStorage) func(*gin.Context) {
+	middleware := func(c *gin.Context) {
+		if storage.RaftNode.State() == raft.Leader {
+			c.Header(servedByHeader, storage.NodeID())
+			c.Next()
+			return
+		}
+		c.Abort()
+		forwardRequest(c, storage)
+	}
+	return middleware
+}
+
+// forwardReadsToLeader is a middleware for read requests.
+// Reads which this node can't serve with the requested consistency
+// are forwarded to the leader the same way as writes.
+func forwardReadsToLeader(storage *node.RStorage) func(*gin.Context) {
+	middleware := func(c *gin.Context) {
+		consistency, err := node.ParseConsistency(c.Query("consistency"))
+		if err != nil {
+			badRequestResponse(c, "invalid_consistency", err)
+			c.Abort()
+			return
+		}
+
+		if storage.CanServeRead(consistency) {
+			c.Header(servedByHeader, storage.NodeID())
+			c.Next()
+			return
+		}
+		c.Abort()
+		forwardRequest(c, storage)
+	}
+	return middleware
+}
+
+// forwardRequest sends the request to the leader and relays the response,
+// or redirects the client to the leader if "?forward=false" is set
+func forwardRequest(c *gin.Context, storage *node.RStorage) {
+	leader := storage.RaftNode.Leader()
+	if leader == "" {
+		errorResponse(c, node.ErrNoLeader)
+		return
+	}
+
+	httpAddress, err := leaderHTTPAddress(storage, leader)
+	if err != nil {
+		log.Printf("[ERROR] Can't resolve HTTP address of the leader %s: %+v", leader, err)
+		errorResponse(c, node.ErrNotLeader)
+		return
+	}
+
+	target := url.URL{
+		Scheme:   "http",
+		Host:     httpAddress,
+		Path:     c.Request.URL.Path,
+		RawPath:  c.Request.URL.RawPath,
+		RawQuery: c.Request.URL.RawQuery,
+	}
+
+	if c.Query("forward") == "false" {
+		c.Redirect(307, target.String())
+		return
+	}
+
+	hops, _ := strconv.Atoi(c.GetHeader(forwardedHopsHeader))
+	if hops >= maxForwardHops {
+		c.JSON(508, gin.H{
+			"code":  "too_many_hops",
+			"error": fmt.Sprintf("Request was forwarded %d times without reaching the leader", hops),
+		})
+		return
+	}
+
+	log.Printf("[DEBUG] Forwarding %s %s to the leader at %s", c.Request.Method, c.Request.URL.Path, httpAddress)
+	if err := proxyRequest(c, target.String(), hops+1); err != nil {
+		log.Printf("[ERROR] Can't forward request to the leader: %+v", err)
+		c.JSON(502, gin.H{
+			"code":  "leader_unreachable",
+			"error": fmt.Sprintf("%+v", err),
+		})
+	}
+}
+
+// proxyRequest sends the request to target and copies the response to the client
+// returns an error only if the response wasn't received, so nothing is written to the client yet
+func proxyRequest(c *gin.Context, target string, hops int) error {
+	req, err := http.NewRequest(c.Request.Method, target, c.Request.Body)
+	if err != nil {
+		return err
+	}
+
+	timeout := forwardTimeout
+	if c.Query("index") != "" || c.Query("wait") != "" || c.GetBool(blockingRequestKey) {
+		timeout += maxBlockingWait
+	}
+	// the forwarded request is cancelled if the client goes away
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	for name, values := range c.Request.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set(forwardedHopsHeader, strconv.Itoa(hops))
+
+	resp, err := forwardClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		c.Writer.Header()[name] = values
+	}
+	c.Status(resp.StatusCode)
+	if _, err := io.Copy(c.Writer, resp.Body); err != nil {
+		log.Printf("[ERROR] Can't copy the leader's response: %+v", err)
+	}
+	return nil
+}
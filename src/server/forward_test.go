@@ -0,0 +1,349 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexander-akhmetov/raft-example/src/node"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	followerNode *node.RStorage
+	followerOnce sync.Once
+)
+
+// getFollowerNode starts the second node and adds it to the cluster as a non-voter,
+// so it doesn't affect the quorum for the other tests
+func getFollowerNode() *node.RStorage {
+	followerOnce.Do(func() {
+		dataDir := "/tmp/test_node_follower/"
+		os.RemoveAll(dataDir)
+
+		config := node.Config{
+			BindAddress:    "127.0.0.1:6667",
+			NodeIdentifier: "127.0.0.1:6667",
+			DataDir:        dataDir,
+		}
+		storage, err := node.NewRStorage(&config)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		future := raftNode.RaftNode.AddNonvoter(raft.ServerID(config.NodeIdentifier), raft.ServerAddress(config.BindAddress), 0, 0)
+		if err := future.Error(); err != nil {
+			log.Panic(err)
+		}
+
+		startedAt := time.Now()
+		for storage.RaftNode.Leader() == "" {
+			if time.Since(startedAt) > time.Second*5 {
+				log.Panicln("Follower can't find the leader!")
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+		followerNode = storage
+	})
+	return followerNode
+}
+
+// serveLeader starts an HTTP server for the leader node and makes followers forward requests to it
+func serveLeader() func() {
+	server := httptest.NewServer(setupRouter(raftNode))
+	serverURL, _ := url.Parse(server.URL)
+
+	originalResolver := resolveHTTPAddress
+	resolveHTTPAddress = func(raftAddress string) (string, error) {
+		return serverURL.Host, nil
+	}
+
+	return func() {
+		resolveHTTPAddress = originalResolver
+		server.Close()
+	}
+}
+
+func TestForwardWriteToLeader(t *testing.T) {
+	defer serveLeader()()
+	router := setupRouter(getFollowerNode())
+	testKey := "test-forward-key"
+	url := "/keys/" + testKey + "/"
+
+	w := performRequest(router, "POST", url, bytes.NewBufferString(`{"value": "forwarded"}`))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	assert.Equal(t, raftNode.NodeID(), w.Header().Get(servedByHeader), "Write must be served by the leader")
+	assert.NotEmpty(t, w.Header().Get("ETag"), "Leader's headers must be relayed")
+
+	value, exists := raftNode.Get(testKey)
+	assert.True(t, exists)
+	assert.Equal(t, "forwarded", value)
+
+	w = performRequest(router, "DELETE", url, nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	assertKeyNotExists(t, testKey)
+
+	// errors are relayed as well
+	w = performRequest(router, "DELETE", url, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, "Response code should be 404")
+
+	// escaped slashes stay in the key
+	w = performRequest(router, "POST", "/keys/test-forward%2Fnested/", bytes.NewBufferString(`{"value": "nested"}`))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	value, exists = raftNode.Get("test-forward/nested")
+	assert.True(t, exists)
+	assert.Equal(t, "nested", value)
+}
+
+func TestForwardRedirect(t *testing.T) {
+	defer serveLeader()()
+	router := setupRouter(getFollowerNode())
+
+	w := performRequest(router, "POST", "/keys/test-redirect-key/?forward=false", bytes.NewBufferString(`{"value": "v"}`))
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code, "Response code should be 307")
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	assert.Nil(t, err)
+	assert.Equal(t, "/keys/test-redirect-key/", location.Path)
+	assertKeyNotExists(t, "test-redirect-key")
+}
+
+func TestForwardHopLimit(t *testing.T) {
+	defer serveLeader()()
+	router := setupRouter(getFollowerNode())
+
+	headers := map[string]string{forwardedHopsHeader: strconv.Itoa(maxForwardHops)}
+	w := performRequestWithHeaders(router, "POST", "/keys/test-hops-key/", bytes.NewBufferString(`{"value": "v"}`), headers)
+	assert.Equal(t, 508, w.Code, "Response code should be 508")
+	assertKeyNotExists(t, "test-hops-key")
+}
+
+func TestReadConsistencyOnFollower(t *testing.T) {
+	defer serveLeader()()
+	follower := getFollowerNode()
+	router := setupRouter(follower)
+	testKey := "test-consistency-key"
+	url := "/keys/" + testKey + "/"
+
+	_, err := raftNode.Set(testKey, "value")
+	assert.Nil(t, err, "Can't write to the node")
+	time.Sleep(time.Millisecond * 200) // wait for value to be replicated
+
+	// stale reads are served by the follower itself
+	w := performRequest(router, "GET", url+"?consistency=stale", nil)
+	assertValue(t, w, "value")
+	assert.Equal(t, follower.NodeID(), w.Header().Get(servedByHeader))
+	assert.NotEmpty(t, w.Header().Get("X-Raft-Applied-Index"))
+	assert.NotEmpty(t, w.Header().Get("X-Raft-Last-Contact"))
+
+	// the follower is in contact with the leader, so it can serve lease reads
+	w = performRequest(router, "GET", url+"?consistency=lease", nil)
+	assertValue(t, w, "value")
+	assert.Equal(t, follower.NodeID(), w.Header().Get(servedByHeader))
+
+	// linearizable reads are forwarded to the leader
+	w = performRequest(router, "GET", url+"?consistency=linearizable", nil)
+	assertValue(t, w, "value")
+	assert.Equal(t, raftNode.NodeID(), w.Header().Get(servedByHeader))
+	assert.Equal(t, "0", w.Header().Get("X-Raft-Last-Contact"), "Leader's last contact must be 0")
+}
+
+func TestReadYourWritesOnFollower(t *testing.T) {
+	follower := getFollowerNode()
+	testKey := "test-read-your-writes-key"
+
+	index, err := raftNode.Set(testKey, "value")
+	assert.Nil(t, err, "Can't write to the node")
+
+	// the follower waits until the write is replicated to it
+	w := performRequest(setupRouter(follower), "GET", "/keys/"+testKey+"/?min_index="+strconv.FormatUint(index, 10), nil)
+	assertValue(t, w, "value")
+	assert.Equal(t, follower.NodeID(), w.Header().Get(servedByHeader))
+
+	assert.Equal(t, node.ErrIndexTimeout, follower.WaitForIndex(index+1000, time.Millisecond*100))
+}
+
+func TestLeave(t *testing.T) {
+	defer serveLeader()()
+	dataDir := "/tmp/test_node_leaving/"
+	os.RemoveAll(dataDir)
+	leaving, err := node.NewRStorage(&node.Config{BindAddress: "127.0.0.1:6668", NodeIdentifier: "leaving", DataDir: dataDir})
+	assert.Nil(t, err)
+	defer leaving.RaftNode.Shutdown()
+
+	future := raftNode.RaftNode.AddNonvoter("leaving", "127.0.0.1:6668", 0, 0)
+	assert.Nil(t, future.Error())
+	for startedAt := time.Now(); leaving.RaftNode.Leader() == ""; time.Sleep(time.Millisecond * 100) {
+		if time.Since(startedAt) > time.Second*5 {
+			t.Fatal("Node can't find the leader")
+		}
+	}
+
+	assert.Nil(t, Leave(leaving), "Follower must ask the leader to remove it")
+	servers, _ := raftNode.GetClusterServers()
+	for _, server := range servers {
+		assert.NotEqual(t, raft.ServerID("leaving"), server.ID, "Node must leave the cluster")
+	}
+}
+
+func TestPromoteAndDemote(t *testing.T) {
+	dataDir := "/tmp/test_node_learner/"
+	os.RemoveAll(dataDir)
+	learner, err := node.NewRStorage(&node.Config{BindAddress: "127.0.0.1:6669", NodeIdentifier: "learner", DataDir: dataDir})
+	assert.Nil(t, err)
+	defer learner.RaftNode.Shutdown()
+
+	learnerServer := httptest.NewServer(setupRouter(learner))
+	defer learnerServer.Close()
+	learnerURL, _ := url.Parse(learnerServer.URL)
+	originalResolver := resolveHTTPAddress
+	resolveHTTPAddress = func(raftAddress string) (string, error) {
+		if raftAddress == "127.0.0.1:6669" {
+			return learnerURL.Host, nil
+		}
+		return originalResolver(raftAddress)
+	}
+	defer func() { resolveHTTPAddress = originalResolver }()
+
+	router := setupRouter(raftNode)
+	w := performRequest(router, "POST", "/cluster/join/", bytes.NewBufferString(`{"id": "learner", "address": "127.0.0.1:6669", "role": "nonvoter"}`))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	assertSuffrage(t, "learner", raft.Nonvoter)
+
+	w = performRequest(router, "POST", "/cluster/servers/learner/promote/?max_lag=0&wait=10s", nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	assertSuffrage(t, "learner", raft.Voter)
+	assert.True(t, learner.AppliedIndex() > 0, "Learner must catch up before the promotion")
+
+	w = performRequest(router, "POST", "/cluster/servers/learner/demote/", nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	assertSuffrage(t, "learner", raft.Nonvoter)
+
+	w = performRequest(router, "POST", "/cluster/servers/127.0.0.1:6666/demote/", nil)
+	assert.Equal(t, http.StatusConflict, w.Code, "The last voter can't be demoted")
+
+	// a non-voter which doesn't respond can't be promoted
+	learnerServer.Close()
+	w = performRequest(router, "POST", "/cluster/servers/learner/promote/?wait=500ms", nil)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code, "Response code should be 504")
+	assertSuffrage(t, "learner", raft.Nonvoter)
+
+	_, err = raftNode.RemoveServer("learner")
+	assert.Nil(t, err)
+}
+
+func TestForwardPromoteWithoutWait(t *testing.T) {
+	dataDir := "/tmp/test_node_slow_learner/"
+	os.RemoveAll(dataDir)
+	learner, err := node.NewRStorage(&node.Config{BindAddress: "127.0.0.1:6670", NodeIdentifier: "slow-learner", DataDir: dataDir})
+	assert.Nil(t, err)
+	defer learner.RaftNode.Shutdown()
+
+	// the learner reports its status only after the forwarded request would time out without waiting
+	availableAt := time.Now().Add(time.Second)
+	learnerRouter := setupRouter(learner)
+	learnerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if time.Now().Before(availableAt) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		learnerRouter.ServeHTTP(w, r)
+	}))
+	defer learnerServer.Close()
+
+	defer serveLeader()()
+	learnerURL, _ := url.Parse(learnerServer.URL)
+	originalResolver := resolveHTTPAddress
+	resolveHTTPAddress = func(raftAddress string) (string, error) {
+		if raftAddress == "127.0.0.1:6670" {
+			return learnerURL.Host, nil
+		}
+		return originalResolver(raftAddress)
+	}
+	defer func() { resolveHTTPAddress = originalResolver }()
+	originalTimeout := forwardTimeout
+	forwardTimeout = time.Millisecond * 300
+	defer func() { forwardTimeout = originalTimeout }()
+
+	future := raftNode.RaftNode.AddNonvoter("slow-learner", "127.0.0.1:6670", 0, 0)
+	assert.Nil(t, future.Error())
+	defer raftNode.RemoveServer("slow-learner")
+
+	router := setupRouter(getFollowerNode())
+	w := performRequest(router, "POST", "/cluster/servers/slow-learner/promote/?max_lag=0", nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Forwarded promotion must wait as long as the leader does")
+	assertSuffrage(t, "slow-learner", raft.Voter)
+}
+
+func assertSuffrage(t *testing.T, id string, suffrage raft.ServerSuffrage) {
+	servers, _ := raftNode.GetClusterServers()
+	for _, server := range servers {
+		if server.ID == raft.ServerID(id) {
+			assert.Equal(t, suffrage, server.Suffrage, "Unexpected suffrage of %s", id)
+			return
+		}
+	}
+	t.Errorf("%s is not in the cluster", id)
+}
+
+func TestRegisteredHTTPAddresses(t *testing.T) {
+	follower := getFollowerNode()
+	leaderServer := httptest.NewServer(setupRouter(raftNode))
+	defer leaderServer.Close()
+	leaderURL, _ := url.Parse(leaderServer.URL)
+	followerServer := httptest.NewServer(setupRouter(follower))
+	defer followerServer.Close()
+	followerURL, _ := url.Parse(followerServer.URL)
+
+	// addresses guessed by the Raft addresses don't work
+	originalResolver := resolveHTTPAddress
+	resolveHTTPAddress = func(raftAddress string) (string, error) {
+		return "127.0.0.1:1", nil
+	}
+	defer func() { resolveHTTPAddress = originalResolver }()
+
+	index, err := raftNode.RegisterNode(raftNode.NodeID(), leaderURL.Host)
+	assert.Nil(t, err)
+	defer raftNode.DeregisterNode(raftNode.NodeID())
+	router := setupRouter(raftNode)
+	body := `{"id": "127.0.0.1:6667", "address": "127.0.0.1:6667", "role": "nonvoter", "http_address": "` + followerURL.Host + `"}`
+	w := performRequest(router, "POST", "/cluster/join/", bytes.NewBufferString(body))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	defer raftNode.DeregisterNode(follower.NodeID())
+	httpAddress, _ := raftNode.NodeHTTPAddress(follower.NodeID())
+	assert.Equal(t, followerURL.Host, httpAddress, "Join must register the HTTP address")
+	assert.Nil(t, follower.WaitForIndex(index, time.Second*5))
+
+	followerRouter := setupRouter(follower)
+	w = performRequest(followerRouter, "POST", "/keys/test-registered-key/?forward=false", bytes.NewBufferString(`{"value": "v"}`))
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code, "Response code should be 307")
+	location, err := url.Parse(w.Header().Get("Location"))
+	assert.Nil(t, err)
+	assert.Equal(t, leaderURL.Host, location.Host, "Follower must redirect to the registered address")
+
+	w = performRequest(followerRouter, "POST", "/keys/test-registered-key/", bytes.NewBufferString(`{"value": "v"}`))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	assert.Equal(t, raftNode.NodeID(), w.Header().Get(servedByHeader), "Write must be forwarded to the registered address")
+
+	w = performRequest(router, "GET", "/cluster/", nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	var response struct {
+		Servers []serverStatus `json:"servers"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	for _, server := range response.Servers {
+		if server.ID == follower.NodeID() {
+			assert.Equal(t, followerURL.Host, server.HTTPAddress)
+			assert.Equal(t, "Follower", server.State, "Status must be fetched from the registered address")
+		}
+	}
+}
@@ -1,15 +1,27 @@
 package server
 
 import (
+	"encoding/base64"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/alexander-akhmetov/raft-example/src/node"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
 type joinData struct {
+	// ID is the Raft server ID of the node, nodes without IDs use their addresses
+	ID      string `json:"id"`
 	Address string `json:"address"`
+	// Role is "voter" (default) or "nonvoter"
+	Role string `json:"role"`
+	// HTTPAddress is the HTTP advertise address of the node, it is registered in the FSM
+	HTTPAddress string `json:"http_address"`
 }
 
 // joinView handles 'join' request from another nodes
@@ -19,16 +31,36 @@ type joinData struct {
 func joinView(storage *node.RStorage) func(*gin.Context) {
 	view := func(c *gin.Context) {
 		var data joinData
-		err := c.BindJSON(&data)
+		err := c.ShouldBindWith(&data, binding.JSON)
 		if err != nil {
-			log.Printf("[ERROR] Reading POST data error: %+v", err)
-			c.JSON(503, gin.H{})
+			badRequestResponse(c, "invalid_request", err)
 			return
 		}
 
-		err = storage.AddVoter(data.Address)
+		if data.Address == "" {
+			badRequestResponse(c, "invalid_request", fmt.Errorf("Address is required"))
+			return
+		}
+		if data.ID == "" {
+			data.ID = data.Address
+		}
+
+		switch data.Role {
+		case "", "voter":
+			err = storage.AddVoter(data.ID, data.Address)
+		case "nonvoter":
+			err = storage.AddNonvoter(data.ID, data.Address)
+		default:
+			badRequestResponse(c, "invalid_request", fmt.Errorf("Unknown role: %s", data.Role))
+			return
+		}
+		if err == nil && data.HTTPAddress != "" {
+			if registered, _ := storage.NodeHTTPAddress(data.ID); registered != data.HTTPAddress {
+				_, err = storage.RegisterNode(data.ID, data.HTTPAddress)
+			}
+		}
 		if err != nil {
-			c.JSON(503, gin.H{})
+			errorResponse(c, err)
 		} else {
 			c.JSON(200, gin.H{})
 		}
@@ -36,57 +68,423 @@ func joinView(storage *node.RStorage) func(*gin.Context) {
 	return view
 }
 
+// getKeyView returns value of the key,
+// with "?index=N&wait=30s" it blocks until the key's modification index differs from N or the wait expires
 func getKeyView(storage *node.RStorage) func(*gin.Context) {
 	view := func(c *gin.Context) {
 		key := c.Param("key")
+		query, ok := parseBlockingQuery(c)
+		if !ok {
+			return
+		}
+		if !prepareRead(c, storage) {
+			return
+		}
+
+		var kv node.KeyValue
+		var exists bool
+		if query != nil {
+			kv, exists = storage.WaitForKeyChange(key, query.index, c.Request.Context().Done(), query.wait)
+			setReadHeaders(c, storage)
+		} else {
+			kv, exists = storage.GetKeyValue(key)
+		}
+		c.Header("X-Raft-Index", strconv.FormatUint(kv.ModifyIndex, 10))
+		if !exists {
+			errorResponse(c, node.ErrKeyNotFound)
+			return
+		}
+		c.Header("ETag", formatETag(kv.ModifyIndex))
+		if kv.ContentType != "" {
+			c.Data(200, kv.ContentType, kv.Value)
+			return
+		}
 		c.JSON(200, gin.H{
-			"value": storage.Get(key),
+			"value": string(kv.Value),
 		})
 	}
 	return view
 }
 
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listKeysView returns keys in lexicographical order:
+// GET /keys/?prefix=app/&start=app/a&end=app/z&limit=10
+// if there are more keys, the response contains "next" token which must be passed as "?continue=<token>"
+func listKeysView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		opts := node.ListOptions{
+			Prefix: c.Query("prefix"),
+			Start:  c.Query("start"),
+			End:    c.Query("end"),
+			Limit:  defaultListLimit,
+		}
+
+		if limit := c.Query("limit"); limit != "" {
+			value, err := strconv.Atoi(limit)
+			if err != nil || value <= 0 || value > maxListLimit {
+				badRequestResponse(c, "invalid_limit", fmt.Errorf("limit must be a number from 1 to %d, got: %s", maxListLimit, limit))
+				return
+			}
+			opts.Limit = value
+		}
+
+		if token := c.Query("continue"); token != "" {
+			start, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				badRequestResponse(c, "invalid_continue", fmt.Errorf("Invalid continue token: %s", token))
+				return
+			}
+			opts.Start = string(start)
+		}
+
+		if !prepareRead(c, storage) {
+			return
+		}
+
+		pairs, next := storage.List(opts)
+		keys := make([]gin.H, 0, len(pairs))
+		for _, pair := range pairs {
+			item := gin.H{
+				"key":   pair.Key,
+				"index": pair.ModifyIndex,
+			}
+			// raw values are base64 encoded
+			if pair.ContentType != "" {
+				item["data"] = pair.Value
+				item["content_type"] = pair.ContentType
+			} else {
+				item["value"] = string(pair.Value)
+			}
+			keys = append(keys, item)
+		}
+
+		response := gin.H{"keys": keys}
+		if next != "" {
+			response["next"] = base64.RawURLEncoding.EncodeToString([]byte(next))
+		}
+		c.JSON(200, response)
+	}
+	return view
+}
+
+// prepareRead waits until the node can serve the read with requested "min_index" and "consistency"
+// returns false if the read can't be served, the error is already written to the response
+func prepareRead(c *gin.Context, storage *node.RStorage) bool {
+	if minIndex := c.Query("min_index"); minIndex != "" {
+		index, err := strconv.ParseUint(minIndex, 10, 64)
+		if err != nil {
+			badRequestResponse(c, "invalid_index", fmt.Errorf("Invalid min_index: %s", minIndex))
+			return false
+		}
+		if err := storage.WaitForIndex(index, minIndexTimeout); err != nil {
+			errorResponse(c, err)
+			return false
+		}
+	}
+
+	// consistency is already validated by forwardReadsToLeader
+	consistency, _ := node.ParseConsistency(c.Query("consistency"))
+	if err := storage.VerifyRead(consistency); err != nil {
+		errorResponse(c, err)
+		return false
+	}
+
+	setReadHeaders(c, storage)
+	return true
+}
+
+const (
+	// defaultBlockingWait is used for blocking queries without "?wait="
+	defaultBlockingWait = time.Minute * 5
+	// maxBlockingWait limits how long a blocking query can wait
+	maxBlockingWait = time.Minute * 10
+)
+
+// blockingQuery contains "?index=N&wait=30s" parameters of a blocking query
+type blockingQuery struct {
+	index uint64
+	wait  time.Duration
+}
+
+// parseBlockingQuery returns nil if the request is not a blocking query
+// returns false if the parameters are invalid, the error is already written to the response
+func parseBlockingQuery(c *gin.Context) (*blockingQuery, bool) {
+	value := c.Query("index")
+	if value == "" {
+		return nil, true
+	}
+	index, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		badRequestResponse(c, "invalid_index", fmt.Errorf("Invalid index: %s", value))
+		return nil, false
+	}
+
+	query := &blockingQuery{index: index, wait: defaultBlockingWait}
+	if value := c.Query("wait"); value != "" {
+		wait, err := time.ParseDuration(value)
+		if err != nil || wait <= 0 {
+			badRequestResponse(c, "invalid_wait", fmt.Errorf("Invalid wait: %s", value))
+			return nil, false
+		}
+		if wait < maxBlockingWait {
+			query.wait = wait
+		} else {
+			query.wait = maxBlockingWait
+		}
+	}
+	return query, true
+}
+
+// minIndexTimeout limits how long a read with "?min_index=N" waits for the index to be applied
+const minIndexTimeout = time.Second * 5
+
+// writeResponse returns the result of a successful write,
+// index can be passed as "?min_index=N" to the following reads to see this write on any node
+func writeResponse(c *gin.Context, index uint64, result gin.H) {
+	c.Header("X-Raft-Index", strconv.FormatUint(index, 10))
+	result["index"] = index
+	c.JSON(200, result)
+}
+
+// setReadHeaders tells the client how fresh the local state of the node is
+func setReadHeaders(c *gin.Context, storage *node.RStorage) {
+	c.Header("X-Raft-Applied-Index", strconv.FormatUint(storage.AppliedIndex(), 10))
+	c.Header("X-Raft-Last-Contact", strconv.FormatInt(int64(storage.LastContact()/time.Millisecond), 10))
+}
+
 type setKeyData struct {
 	Value string `json:"value"`
+	// TTL is a duration after which the key is deleted, e.g. "30s"
+	TTL string `json:"ttl"`
+	// Lease is ID of the lease to attach the key to
+	Lease uint64 `json:"lease"`
 }
 
 func setKeyView(storage *node.RStorage) func(*gin.Context) {
 	view := func(c *gin.Context) {
 		key := c.Param("key")
 		var data setKeyData
-		err := c.BindJSON(&data)
+		err := c.ShouldBindWith(&data, binding.JSON)
 		if err != nil {
-			log.Printf("[ERROR] Reading POST data error: %+v", err)
-			c.JSON(503, gin.H{})
+			badRequestResponse(c, "invalid_request", err)
+			return
 		}
 
-		err = storage.Set(key, data.Value)
+		opts, ok := parseSetOptions(c, data.TTL, data.Lease)
+		if !ok {
+			return
+		}
+		writeKey(c, storage, key, []byte(data.Value), opts, gin.H{
+			"value": data.Value,
+		})
+	}
+	return view
+}
+
+// maxValueSize limits the size of a raw value
+const maxValueSize = 1024 * 1024
+
+// putKeyView stores the request body as a raw value:
+// PUT /keys/<key>/?ttl=30s&lease=<id>
+// the Content-Type of the request is stored with the value and returned by GET
+func putKeyView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		key := c.Param("key")
+		value, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxValueSize+1))
 		if err != nil {
-			c.JSON(503, gin.H{
-				"code":  "some_code", // todo :)
-				"error": fmt.Sprintf("%+v", err),
+			badRequestResponse(c, "invalid_request", err)
+			return
+		}
+		if len(value) > maxValueSize {
+			c.JSON(413, gin.H{
+				"code":  "value_too_large",
+				"error": fmt.Sprintf("Value can't be larger than %d bytes", maxValueSize),
 			})
+			return
+		}
+
+		var lease uint64
+		if param := c.Query("lease"); param != "" {
+			lease, err = strconv.ParseUint(param, 10, 64)
+			if err != nil {
+				badRequestResponse(c, "invalid_lease", fmt.Errorf("Invalid lease ID: %s", param))
+				return
+			}
+		}
+		opts, ok := parseSetOptions(c, c.Query("ttl"), lease)
+		if !ok {
+			return
+		}
+		opts.ContentType = c.GetHeader("Content-Type")
+		if opts.ContentType == "" {
+			opts.ContentType = "application/octet-stream"
+		}
+
+		writeKey(c, storage, key, value, opts, gin.H{
+			"size": len(value),
+		})
+	}
+	return view
+}
+
+// parseSetOptions validates TTL and lease of a write
+// returns false if they are invalid, the error is already written to the response
+func parseSetOptions(c *gin.Context, ttl string, lease uint64) (node.SetOptions, bool) {
+	opts := node.SetOptions{Lease: lease}
+	if ttl == "" {
+		return opts, true
+	}
+	if lease != 0 {
+		badRequestResponse(c, "invalid_ttl", fmt.Errorf("A key can't have both ttl and lease"))
+		return opts, false
+	}
+
+	var err error
+	opts.TTL, err = time.ParseDuration(ttl)
+	if err != nil || opts.TTL <= 0 {
+		badRequestResponse(c, "invalid_ttl", fmt.Errorf("Invalid ttl: %s", ttl))
+		return opts, false
+	}
+	return opts, true
+}
+
+// writeKey sets the value and writes result to the response,
+// the write is conditional if the request has If-Match or If-None-Match header
+func writeKey(c *gin.Context, storage *node.RStorage, key string, value []byte, opts node.SetOptions, result gin.H) {
+	if c.GetHeader("If-Match") != "" || c.GetHeader("If-None-Match") != "" {
+		compareAndSetKey(c, storage, key, value, opts, result)
+		return
+	}
+
+	revision, err := storage.SetWithOptions(key, value, opts)
+	if err != nil {
+		errorResponse(c, err)
+	} else {
+		c.Header("ETag", formatETag(revision))
+		writeResponse(c, revision, result)
+	}
+}
+
+// compareAndSetKey handles conditional writes:
+// "If-Match: <etag>" sets the value only if the key's revision matches the ETag,
+// "If-None-Match: *" sets the value only if the key doesn't exist
+func compareAndSetKey(c *gin.Context, storage *node.RStorage, key string, value []byte, opts node.SetOptions, result gin.H) {
+	var expectedRevision uint64
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" {
+		revision, err := parseETag(ifMatch)
+		if err != nil || revision == 0 {
+			badRequestResponse(c, "invalid_revision", fmt.Errorf("Invalid If-Match header: %s", ifMatch))
+			return
+		}
+		expectedRevision = revision
+	} else if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "*" {
+		badRequestResponse(c, "invalid_revision", fmt.Errorf("Only \"*\" is supported in If-None-Match header, got: %s", ifNoneMatch))
+		return
+	}
+
+	revision, err := storage.CompareAndSet(key, value, expectedRevision, opts)
+	if revision != 0 {
+		c.Header("ETag", formatETag(revision))
+	}
+	if err != nil {
+		errorResponse(c, err)
+	} else {
+		writeResponse(c, revision, result)
+	}
+}
+
+// formatETag returns key revision as a strong ETag value
+func formatETag(revision uint64) string {
+	return fmt.Sprintf("\"%d\"", revision)
+}
+
+// parseETag reads key revision from ETag value, quotes are optional
+func parseETag(etag string) (uint64, error) {
+	return strconv.ParseUint(strings.Trim(strings.TrimSpace(etag), "\""), 10, 64)
+}
+
+func deleteKeyView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		key := c.Param("key")
+		index, err := storage.Delete(key)
+		if err != nil {
+			errorResponse(c, err)
 		} else {
-			c.JSON(200, gin.H{
-				"value": data.Value,
+			writeResponse(c, index, gin.H{
+				"deleted": true,
 			})
 		}
 	}
 	return view
 }
 
+// txnView applies several guarded operations atomically:
+// if all "compare" conditions succeed, "success" operations are applied, otherwise "failure" operations
+func txnView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		var txn node.TxnRequest
+		if err := c.ShouldBindWith(&txn, binding.JSON); err != nil {
+			badRequestResponse(c, "invalid_request", err)
+			return
+		}
+		if err := txn.Validate(); err != nil {
+			badRequestResponse(c, "invalid_txn", err)
+			return
+		}
+
+		result, err := storage.Txn(&txn)
+		if err != nil {
+			errorResponse(c, err)
+			return
+		}
+		writeResponse(c, result.Index, gin.H{
+			"succeeded": result.Succeeded,
+			"results":   result.Results,
+		})
+	}
+	return view
+}
+
 func setupRouter(raftNode *node.RStorage) *gin.Engine {
 	router := gin.Default()
+	// hierarchical keys like "app/config" are sent with an escaped slash: /keys/app%2Fconfig/,
+	// the router matches the escaped path and unescapes the parameters
+	router.UseRawPath = true
+	router.UnescapePathValues = true
 
-	router.POST("/cluster/join/", joinView(raftNode))
-	router.GET("/keys/:key/", getKeyView(raftNode))
-	router.POST("/keys/:key/", setKeyView(raftNode))
+	router.POST("/cluster/join/", forwardToLeader(raftNode), joinView(raftNode))
+	router.GET("/cluster/", clusterStatusView(raftNode))
+	router.GET("/cluster/local/", localStatusView(raftNode))
+	router.DELETE("/cluster/servers/:id/", forwardToLeader(raftNode), removeServerView(raftNode))
+	router.POST("/cluster/servers/:id/promote/", blockingRequest, forwardToLeader(raftNode), promoteServerView(raftNode))
+	router.POST("/cluster/servers/:id/demote/", forwardToLeader(raftNode), demoteServerView(raftNode))
+	router.GET("/keys/", forwardReadsToLeader(raftNode), listKeysView(raftNode))
+	router.GET("/keys/:key/", forwardReadsToLeader(raftNode), getKeyView(raftNode))
+	router.POST("/keys/:key/", forwardToLeader(raftNode), postKeyView(raftNode))
+	router.PUT("/keys/:key/", forwardToLeader(raftNode), putKeyView(raftNode))
+	router.DELETE("/keys/:key/", forwardToLeader(raftNode), deleteKeyView(raftNode))
+	router.POST("/txn/", forwardToLeader(raftNode), txnView(raftNode))
+	router.GET("/watch/", watchView(raftNode))
+	router.POST("/leases/", forwardToLeader(raftNode), grantLeaseView(raftNode))
+	router.GET("/leases/:id/", forwardReadsToLeader(raftNode), getLeaseView(raftNode))
+	router.POST("/leases/:id/keepalive/", forwardToLeader(raftNode), keepAliveLeaseView(raftNode))
+	router.DELETE("/leases/:id/", forwardToLeader(raftNode), revokeLeaseView(raftNode))
+	router.GET("/locks/:name/", forwardReadsToLeader(raftNode), getLockView(raftNode))
+	router.POST("/locks/:name/acquire/", forwardToLeader(raftNode), acquireLockView(raftNode))
+	router.POST("/locks/:name/release/", forwardToLeader(raftNode), releaseLockView(raftNode))
+	router.GET("/counters/:name/", forwardReadsToLeader(raftNode), getCounterView(raftNode))
+	router.POST("/counters/:name/incr/", forwardToLeader(raftNode), incrementCounterView(raftNode))
+	router.POST("/counters/:name/reserve/", forwardToLeader(raftNode), reserveRangeView(raftNode))
 
 	return router
 }
 
-// RunHTTPServer starts HTTP server
-func RunHTTPServer(raftNode *node.RStorage) {
+// RunHTTPServer starts HTTP server on bindAddress, e.g. ":8080"
+func RunHTTPServer(raftNode *node.RStorage, bindAddress string) error {
 	router := setupRouter(raftNode)
-	router.Run() // listen and serve on 0.0.0.0:8080
+	return router.Run(bindAddress)
 }
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -9,6 +10,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -32,6 +37,7 @@ func setupNode() *node.RStorage {
 		JoinAddress:    "127.0.0.1:6666",
 		DataDir:        dataDir,
 		Bootstrap:      true,
+		MaxBatchSize:   64,
 	}
 	storage, err := node.NewRStorage(&config)
 	if err != nil {
@@ -41,8 +47,15 @@ func setupNode() *node.RStorage {
 }
 
 func performRequest(r http.Handler, method, path string, body io.Reader) *httptest.ResponseRecorder {
+	return performRequestWithHeaders(r, method, path, body, nil)
+}
+
+func performRequestWithHeaders(r http.Handler, method, path string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
 	req, _ := http.NewRequest(method, path, body)
 	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
 	w := httptest.NewRecorder()
 	r.ServeHTTP(w, req)
 	return w
@@ -58,6 +71,21 @@ func assertValue(t *testing.T, w *httptest.ResponseRecorder, expectedValue strin
 	assert.Equal(t, expectedValue, value, "Values should be equal")
 }
 
+func assertNotFound(t *testing.T, w *httptest.ResponseRecorder) {
+	assert.Equal(t, http.StatusNotFound, w.Code, "Response code should be 404")
+
+	var response map[string]string
+	json.Unmarshal([]byte(w.Body.String()), &response)
+	assert.Equal(t, "key_not_found", response["code"], "Error code should be key_not_found")
+	_, hasValue := response["value"]
+	assert.False(t, hasValue, "Response for a missing key must not contain a value")
+}
+
+func assertKeyNotExists(t *testing.T, key string) {
+	_, exists := raftNode.Get(key)
+	assert.False(t, exists, "KV storage must not contain the key")
+}
+
 func getLeaderNode() *node.RStorage {
 	raftNode := setupNode()
 	startedAt := time.Now().Unix()
@@ -81,14 +109,14 @@ func TestGetValue(t *testing.T) {
 	url := fmt.Sprintf("/keys/%s/", testKey)
 
 	// kv storage must be empty before the test
-	assert.Equal(t, "", raftNode.Get(testKey), "KV storage must be empty before the test")
+	assertKeyNotExists(t, testKey)
 
-	// check that GET with empty storage returns 200
+	// check that GET with empty storage returns 404
 	w := performRequest(router, "GET", url, nil)
-	assertValue(t, w, "")
+	assertNotFound(t, w)
 
 	// set value and then get it with http request
-	err := raftNode.Set(testKey, testValue)
+	_, err := raftNode.Set(testKey, testValue)
 	assert.Nil(t, err, "Can't write to the node")
 	time.Sleep(time.Millisecond * 100) // wait for value to be applied
 
@@ -103,11 +131,11 @@ func TestSetValueViaHTTP(t *testing.T) {
 	url := fmt.Sprintf("/keys/%s/", testKey)
 
 	// kv storage must be empty before the test
-	assert.Equal(t, "", raftNode.Get(testKey), "KV storage must be empty before the test")
+	assertKeyNotExists(t, testKey)
 
-	// check that GET with empty storage returns 200
+	// check that GET with empty storage returns 404
 	w := performRequest(router, "GET", url, nil)
-	assertValue(t, w, "")
+	assertNotFound(t, w)
 
 	// set value and then get it with http request
 
@@ -120,6 +148,769 @@ func TestSetValueViaHTTP(t *testing.T) {
 	assertValue(t, w, testValue)
 }
 
+func TestGetEmptyValue(t *testing.T) {
+	router := setupRouter(raftNode)
+	testKey := "test-empty-key"
+	url := fmt.Sprintf("/keys/%s/", testKey)
+
+	w := performRequest(router, "GET", url, nil)
+	assertNotFound(t, w)
+
+	// key explicitly set to an empty string exists
+	_, err := raftNode.Set(testKey, "")
+	assert.Nil(t, err, "Can't write to the node")
+	time.Sleep(time.Millisecond * 100) // wait for value to be applied
+
+	value, exists := raftNode.Get(testKey)
+	assert.True(t, exists, "Key with an empty value must exist")
+	assert.Equal(t, "", value)
+
+	w = performRequest(router, "GET", url, nil)
+	assertValue(t, w, "")
+}
+
+func TestDeleteValueViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+	testKey := "test-key3"
+	testValue := "test-value3"
+	url := fmt.Sprintf("/keys/%s/", testKey)
+
+	// deleting a key which doesn't exist returns 404
+	w := performRequest(router, "DELETE", url, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, "Response code should be 404")
+
+	_, err := raftNode.Set(testKey, testValue)
+	assert.Nil(t, err, "Can't write to the node")
+	time.Sleep(time.Millisecond * 100) // wait for value to be applied
+
+	w = performRequest(router, "DELETE", url, nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+
+	var response map[string]interface{}
+	json.Unmarshal([]byte(w.Body.String()), &response)
+	assert.Equal(t, true, response["deleted"], "Key should be deleted")
+	assert.NotEmpty(t, w.Header().Get("X-Raft-Index"), "Response must contain the write index")
+
+	assertKeyNotExists(t, testKey)
+
+	// second DELETE doesn't find the key anymore
+	w = performRequest(router, "DELETE", url, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, "Response code should be 404")
+}
+
+func TestCompareAndSetViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+	testKey := "test-cas-key"
+	url := fmt.Sprintf("/keys/%s/", testKey)
+	body := func(value string) io.Reader {
+		return bytes.NewBufferString(fmt.Sprintf("{\"value\": \"%s\"}", value))
+	}
+
+	// create the key only if it doesn't exist
+	w := performRequestWithHeaders(router, "POST", url, body("v1"), map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag, "Response must contain ETag")
+
+	w = performRequestWithHeaders(router, "POST", url, body("v2"), map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusConflict, w.Code, "Key already exists, response code should be 409")
+	assert.Equal(t, etag, w.Header().Get("ETag"), "Conflict response must contain the current ETag")
+
+	w = performRequest(router, "GET", url, nil)
+	assertValue(t, w, "v1")
+	assert.Equal(t, etag, w.Header().Get("ETag"), "GET must return the same ETag as the write")
+
+	// update with the current revision
+	w = performRequestWithHeaders(router, "POST", url, body("v2"), map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	newETag := w.Header().Get("ETag")
+	assert.NotEqual(t, etag, newETag, "Revision must be changed after the write")
+
+	// the old revision is stale now
+	w = performRequestWithHeaders(router, "POST", url, body("v3"), map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code, "Response code should be 412")
+
+	w = performRequest(router, "GET", url, nil)
+	assertValue(t, w, "v2")
+
+	w = performRequestWithHeaders(router, "POST", url, body("v3"), map[string]string{"If-Match": "not-a-revision"})
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400")
+
+	// revision of a deleted key doesn't match anymore
+	_, err := raftNode.Delete(testKey)
+	assert.Nil(t, err)
+	w = performRequestWithHeaders(router, "POST", url, body("v3"), map[string]string{"If-Match": newETag})
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code, "Response code should be 412")
+	assertKeyNotExists(t, testKey)
+}
+
+func TestSetReturnsRevision(t *testing.T) {
+	testKey := "test-revision-key"
+
+	revision, err := raftNode.Set(testKey, "value")
+	assert.Nil(t, err, "Can't write to the node")
+
+	// Set waits until the value is applied, so it is visible immediately
+	kv, exists := raftNode.GetKeyValue(testKey)
+	assert.True(t, exists)
+	assert.Equal(t, revision, kv.ModifyIndex, "Set must return the new revision of the key")
+}
+
+func TestErrorStatus(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{node.ErrNotLeader, 421, "not_leader"},
+		{node.ErrLeadershipLost, 503, "leadership_lost"},
+		{node.ErrTimeout, 504, "timeout"},
+		{node.ErrKeyNotFound, 404, "key_not_found"},
+		{node.ErrKeyExists, 409, "key_exists"},
+		{node.ErrRevisionMismatch, 412, "revision_mismatch"},
+		{node.ErrCompacted, 410, "compacted"},
+		{node.ErrBulkAborted, 409, "aborted"},
+		{node.ErrBulkTooLarge, 413, "bulk_too_large"},
+		{node.ErrServerNotFound, 404, "server_not_found"},
+		{node.ErrMinVoters, 409, "min_voters"},
+		{node.ErrCatchUpTimeout, 504, "catch_up_timeout"},
+		{node.ErrAddressInUse, 409, "address_in_use"},
+		{node.ErrInvalidDelta, 400, "invalid_delta"},
+		{&node.FSMError{Err: fmt.Errorf("fsm")}, 500, "apply_failed"},
+		{fmt.Errorf("unknown"), 500, "internal_error"},
+	}
+	for _, tc := range cases {
+		status, code := errorStatus(tc.err)
+		assert.Equal(t, tc.status, status, "Unexpected status for %v", tc.err)
+		assert.Equal(t, tc.code, code, "Unexpected code for %v", tc.err)
+	}
+
+	router := setupRouter(raftNode)
+	w := performRequest(router, "POST", "/keys/test-invalid-body/", bytes.NewBufferString("not a json"))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400")
+}
+
+func TestReadConsistencyOnLeader(t *testing.T) {
+	router := setupRouter(raftNode)
+	testKey := "test-leader-consistency-key"
+	url := fmt.Sprintf("/keys/%s/", testKey)
+
+	_, err := raftNode.Set(testKey, "value")
+	assert.Nil(t, err, "Can't write to the node")
+
+	for _, consistency := range []string{"stale", "lease", "linearizable"} {
+		w := performRequest(router, "GET", url+"?consistency="+consistency, nil)
+		assertValue(t, w, "value")
+	}
+
+	w := performRequest(router, "GET", url+"?consistency=strong", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400")
+}
+
+func TestMinIndexRead(t *testing.T) {
+	router := setupRouter(raftNode)
+	testKey := "test-min-index-key"
+	url := fmt.Sprintf("/keys/%s/", testKey)
+
+	w := performRequest(router, "POST", url, bytes.NewBufferString(`{"value": "value"}`))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	index := w.Header().Get("X-Raft-Index")
+
+	var response map[string]interface{}
+	json.Unmarshal([]byte(w.Body.String()), &response)
+	assert.Equal(t, index, fmt.Sprintf("%v", response["index"]), "Write index must be in the body and in the header")
+
+	w = performRequest(router, "GET", url+"?min_index="+index, nil)
+	assertValue(t, w, "value")
+
+	w = performRequest(router, "GET", url+"?min_index=abc", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400")
+}
+
+func TestHierarchicalKeyViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+	url := "/keys/app%2Fconfig%2Fdb/"
+
+	w := performRequest(router, "POST", url, bytes.NewBufferString(`{"value": "nested"}`))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	value, exists := raftNode.Get("app/config/db")
+	assert.True(t, exists, "Escaped slashes must be a part of the key")
+	assert.Equal(t, "nested", value)
+
+	w = performRequest(router, "GET", url, nil)
+	assertValue(t, w, "nested")
+
+	w = performRequest(router, "GET", "/keys/?prefix=app/config/", nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	assert.Contains(t, w.Body.String(), `"key":"app/config/db"`)
+
+	w = performRequest(router, "DELETE", url, nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	assertKeyNotExists(t, "app/config/db")
+}
+
+func TestListKeysViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+	for _, key := range []string{"list-test/c", "list-test/a", "list-test/b", "list-test-other"} {
+		_, err := raftNode.Set(key, "value-"+key)
+		assert.Nil(t, err, "Can't write to the node")
+	}
+
+	type listResponse struct {
+		Keys []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Index uint64 `json:"index"`
+		} `json:"keys"`
+		Next string `json:"next"`
+	}
+	list := func(query string) listResponse {
+		w := performRequest(router, "GET", "/keys/?"+query, nil)
+		assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+		var response listResponse
+		json.Unmarshal([]byte(w.Body.String()), &response)
+		return response
+	}
+
+	response := list("prefix=list-test/&limit=2")
+	assert.Len(t, response.Keys, 2)
+	assert.Equal(t, "list-test/a", response.Keys[0].Key)
+	assert.Equal(t, "value-list-test/a", response.Keys[0].Value)
+	assert.NotZero(t, response.Keys[0].Index)
+	assert.Equal(t, "list-test/b", response.Keys[1].Key)
+	assert.NotEmpty(t, response.Next, "Response must contain a continuation token")
+
+	response = list("prefix=list-test/&limit=2&continue=" + response.Next)
+	assert.Len(t, response.Keys, 1)
+	assert.Equal(t, "list-test/c", response.Keys[0].Key)
+	assert.Empty(t, response.Next)
+
+	response = list("prefix=list-test&start=list-test/b&end=list-test/c")
+	assert.Len(t, response.Keys, 1)
+	assert.Equal(t, "list-test/b", response.Keys[0].Key)
+
+	w := performRequest(router, "GET", "/keys/?limit=0", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400")
+}
+
+func TestTxnViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+	_, err := raftNode.Set("txn-test/a", "1")
+	assert.Nil(t, err, "Can't write to the node")
+
+	body := `{
+		"compare": [{"key": "txn-test/a", "target": "value", "value": "1"}],
+		"success": [
+			{"type": "set", "key": "txn-test/a", "value": "2"},
+			{"type": "set", "key": "txn-test/b", "value": "3"}
+		],
+		"failure": [{"type": "get", "key": "txn-test/a"}]
+	}`
+
+	type txnResponse struct {
+		Succeeded bool               `json:"succeeded"`
+		Index     uint64             `json:"index"`
+		Results   []node.TxnOpResult `json:"results"`
+	}
+
+	w := performRequest(router, "POST", "/txn/", bytes.NewBufferString(body))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	var response txnResponse
+	json.Unmarshal([]byte(w.Body.String()), &response)
+	assert.True(t, response.Succeeded)
+	assert.Len(t, response.Results, 2)
+	assert.NotZero(t, response.Index)
+
+	value, _ := raftNode.Get("txn-test/a")
+	assert.Equal(t, "2", value)
+	value, _ = raftNode.Get("txn-test/b")
+	assert.Equal(t, "3", value)
+
+	// the compare fails now
+	w = performRequest(router, "POST", "/txn/", bytes.NewBufferString(body))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	response = txnResponse{}
+	json.Unmarshal([]byte(w.Body.String()), &response)
+	assert.False(t, response.Succeeded)
+	kv, _ := raftNode.GetKeyValue("txn-test/a")
+	assert.Equal(t, []node.TxnOpResult{{Type: "get", Key: "txn-test/a", Value: "2", Exists: true, Revision: kv.ModifyIndex}}, response.Results)
+
+	w = performRequest(router, "POST", "/txn/", bytes.NewBufferString(`{"success": [{"type": "put", "key": "a"}]}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400")
+}
+
+func TestWatchViaHTTP(t *testing.T) {
+	server := httptest.NewServer(setupRouter(raftNode))
+	defer server.Close()
+
+	index, err := raftNode.Set("watch-test/a", "1")
+	assert.Nil(t, err, "Can't write to the node")
+	_, err = raftNode.Set("watch-test-other", "2")
+	assert.Nil(t, err, "Can't write to the node")
+
+	client := &http.Client{Timeout: time.Second * 5}
+	resp, err := client.Get(fmt.Sprintf("%s/watch/?prefix=watch-test/&from_index=%d", server.URL, index))
+	assert.Nil(t, err, "Can't start watching")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Response code should be 200")
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	_, err = raftNode.Delete("watch-test/a")
+	assert.Nil(t, err, "Can't delete the key")
+
+	var events []node.WatchEvent
+	reader := bufio.NewReader(resp.Body)
+	for len(events) < 2 {
+		line, err := reader.ReadString('\n')
+		if !assert.Nil(t, err, "Can't read the event stream") {
+			return
+		}
+		if strings.HasPrefix(line, "data:") {
+			var event node.WatchEvent
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &event)
+			events = append(events, event)
+		}
+	}
+	assert.Equal(t, node.WatchEvent{Type: "set", Key: "watch-test/a", Value: "1", Index: index}, events[0])
+	assert.Equal(t, "delete", events[1].Type)
+	assert.Equal(t, "watch-test/a", events[1].Key)
+
+	w := performRequest(setupRouter(raftNode), "GET", "/watch/?from_index=abc", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400")
+	w = performRequest(setupRouter(raftNode), "GET", "/watch/?from_id=15", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400")
+}
+
+func TestWatchResumeViaHTTP(t *testing.T) {
+	server := httptest.NewServer(setupRouter(raftNode))
+	defer server.Close()
+
+	response, err := raftNode.Txn(&node.TxnRequest{Success: []node.TxnOp{
+		{Type: "set", Key: "watch-resume/a", Value: "1"},
+		{Type: "set", Key: "watch-resume/b", Value: "2"},
+		{Type: "set", Key: "watch-resume/c", Value: "3"},
+	}})
+	assert.Nil(t, err, "Can't write to the node")
+
+	// readIDs returns ids of the first n events of the stream
+	readIDs := func(query string, headers map[string]string, n int) []string {
+		req, _ := http.NewRequest("GET", server.URL+"/watch/?prefix=watch-resume/&"+query, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := (&http.Client{Timeout: time.Second * 5}).Do(req)
+		if !assert.Nil(t, err, "Can't start watching") {
+			return nil
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Response code should be 200")
+
+		var ids []string
+		reader := bufio.NewReader(resp.Body)
+		for len(ids) < n {
+			line, err := reader.ReadString('\n')
+			if !assert.Nil(t, err, "Can't read the event stream") {
+				return ids
+			}
+			if strings.HasPrefix(line, "id:") {
+				ids = append(ids, strings.TrimSpace(strings.TrimPrefix(line, "id:")))
+			}
+		}
+		return ids
+	}
+
+	index := response.Index
+	id := func(seq int) string { return fmt.Sprintf("%d.%d", index, seq) }
+	assert.Equal(t, []string{id(0), id(1), id(2)}, readIDs(fmt.Sprintf("from_index=%d", index), nil, 3))
+
+	// the stream dropped after the first event of the transaction
+	assert.Equal(t, []string{id(1), id(2)}, readIDs("from_id="+id(0), nil, 2))
+	assert.Equal(t, []string{id(2)}, readIDs("", map[string]string{"Last-Event-ID": id(1)}, 1))
+}
+
+func TestBlockingQueryViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+	testKey := "test-blocking-key"
+	url := fmt.Sprintf("/keys/%s/", testKey)
+
+	index, err := raftNode.Set(testKey, "1")
+	assert.Nil(t, err, "Can't write to the node")
+
+	w := performRequest(router, "GET", url, nil)
+	assertValue(t, w, "1")
+	assert.Equal(t, fmt.Sprint(index), w.Header().Get("X-Raft-Index"), "Response must contain modification index of the key")
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- performRequest(router, "GET", fmt.Sprintf("%s?index=%d&wait=5s", url, index), nil)
+	}()
+	time.Sleep(time.Millisecond * 50)
+	newIndex, err := raftNode.Set(testKey, "2")
+	assert.Nil(t, err, "Can't write to the node")
+
+	w = <-done
+	assertValue(t, w, "2")
+	assert.Equal(t, fmt.Sprint(newIndex), w.Header().Get("X-Raft-Index"))
+
+	w = performRequest(router, "GET", fmt.Sprintf("%s?index=%d&wait=10ms", url, newIndex), nil)
+	assertValue(t, w, "2")
+
+	w = performRequest(router, "GET", url+"?index=1&wait=forever", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400")
+}
+
+func TestKeyTTLViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+	url := "/keys/test-ttl-key/"
+
+	w := performRequest(router, "POST", url, bytes.NewBufferString(`{"value": "value", "ttl": "100ms"}`))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	assertValue(t, performRequest(router, "GET", url, nil), "value")
+
+	time.Sleep(time.Millisecond * 150)
+	assertNotFound(t, performRequest(router, "GET", url, nil))
+
+	w = performRequest(router, "POST", url, bytes.NewBufferString(`{"value": "value", "ttl": "-1s"}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400")
+}
+
+func TestLeasesViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+
+	w := performRequest(router, "POST", "/leases/", bytes.NewBufferString(`{"ttl": "1m"}`))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	var lease struct {
+		ID  uint64 `json:"id"`
+		TTL string `json:"ttl"`
+	}
+	json.Unmarshal([]byte(w.Body.String()), &lease)
+	assert.NotZero(t, lease.ID)
+	assert.Equal(t, "1m0s", lease.TTL)
+	leaseURL := fmt.Sprintf("/leases/%d/", lease.ID)
+
+	w = performRequest(router, "POST", "/keys/lease-test-key/", bytes.NewBufferString(fmt.Sprintf(`{"value": "value", "lease": %d}`, lease.ID)))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+
+	w = performRequest(router, "GET", leaseURL, nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	var leaseKeys struct {
+		Keys []string `json:"keys"`
+	}
+	json.Unmarshal([]byte(w.Body.String()), &leaseKeys)
+	assert.Equal(t, []string{"lease-test-key"}, leaseKeys.Keys)
+
+	w = performRequest(router, "POST", leaseURL+"keepalive/", nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+
+	w = performRequest(router, "DELETE", leaseURL, nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	assertKeyNotExists(t, "lease-test-key")
+
+	for _, method := range []string{"GET", "DELETE"} {
+		w = performRequest(router, method, leaseURL, nil)
+		assert.Equal(t, http.StatusNotFound, w.Code, "Response code should be 404")
+	}
+	w = performRequest(router, "POST", leaseURL+"keepalive/", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, "Response code should be 404")
+	w = performRequest(router, "POST", "/keys/lease-test-key/", bytes.NewBufferString(fmt.Sprintf(`{"value": "value", "lease": %d}`, lease.ID)))
+	assert.Equal(t, http.StatusNotFound, w.Code, "Response code should be 404")
+}
+
+func TestCountersViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+
+	type counterResponse struct {
+		Value int64 `json:"value"`
+		Start int64 `json:"start"`
+		End   int64 `json:"end"`
+	}
+	request := func(method string, url string) counterResponse {
+		w := performRequest(router, method, url, nil)
+		assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+		var response counterResponse
+		json.Unmarshal([]byte(w.Body.String()), &response)
+		return response
+	}
+
+	assert.Equal(t, int64(0), request("GET", "/counters/test-ids/").Value)
+	assert.Equal(t, int64(1), request("POST", "/counters/test-ids/incr/").Value)
+	assert.Equal(t, int64(11), request("POST", "/counters/test-ids/incr/?by=10").Value)
+
+	reserved := request("POST", "/counters/test-ids/reserve/?count=100")
+	assert.Equal(t, int64(12), reserved.Start)
+	assert.Equal(t, int64(111), reserved.End)
+	assert.Equal(t, int64(111), request("GET", "/counters/test-ids/").Value)
+
+	w := performRequest(router, "POST", "/counters/test-ids/reserve/?count=0", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400")
+	for _, by := range []string{"x", "0", "-5"} {
+		w = performRequest(router, "POST", "/counters/test-ids/incr/?by="+by, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400 for by=%s", by)
+		assert.Contains(t, w.Body.String(), "invalid_delta")
+	}
+	assert.Equal(t, int64(111), request("GET", "/counters/test-ids/").Value, "Counter must not change")
+}
+
+func TestBinaryValueViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+	url := "/keys/test-binary-key/"
+	value := []byte{0, 0xff, 0xfe, '\n', 0x80}
+
+	req, _ := http.NewRequest("PUT", url, bytes.NewReader(value))
+	req.Header.Set("Content-Type", "image/png")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	etag := w.Header().Get("ETag")
+
+	w = performRequest(router, "GET", url, nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"), "Content-Type must be stored with the value")
+	assert.Equal(t, value, w.Body.Bytes())
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+
+	w = performRequest(router, "GET", "/keys/?prefix=test-binary-key", nil)
+	var response struct {
+		Keys []struct {
+			Data        []byte `json:"data"`
+			ContentType string `json:"content_type"`
+		} `json:"keys"`
+	}
+	json.Unmarshal([]byte(w.Body.String()), &response)
+	assert.Len(t, response.Keys, 1)
+	assert.Equal(t, value, response.Keys[0].Data, "Raw values must be base64 encoded in lists")
+	assert.Equal(t, "image/png", response.Keys[0].ContentType)
+
+	w = performRequest(router, "POST", "/txn/", bytes.NewBufferString(`{"success": [{"type": "get", "key": "test-binary-key"}]}`))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	var txnResponse struct {
+		Results []node.TxnOpResult `json:"results"`
+	}
+	json.Unmarshal([]byte(w.Body.String()), &txnResponse)
+	assert.Len(t, txnResponse.Results, 1)
+	assert.Equal(t, value, txnResponse.Results[0].Data, "Raw values must be base64 encoded in txn results")
+	assert.Equal(t, "image/png", txnResponse.Results[0].ContentType)
+	assert.Empty(t, txnResponse.Results[0].Value)
+
+	req, _ = http.NewRequest("PUT", url, bytes.NewReader(make([]byte, maxValueSize+1)))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, "Response code should be 413")
+}
+
+func TestConcurrentWritesViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("test-concurrent-%d", i)
+			w := performRequest(router, "POST", "/keys/"+key+"/", strings.NewReader(fmt.Sprintf(`{"value": "%d"}`, i)))
+			assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+
+			kv, exists := raftNode.GetKeyValue(key)
+			assert.True(t, exists)
+			assert.Equal(t, strconv.Itoa(i), string(kv.Value))
+			assert.Equal(t, w.Header().Get("X-Raft-Index"), strconv.FormatUint(kv.ModifyIndex, 10),
+				"Every write must get its own result")
+		}(i)
+	}
+	wg.Wait()
+}
+
+// BenchmarkConcurrentWrites measures throughput of writes sent by many clients at once,
+// run with "-cpu" to change the number of clients
+func BenchmarkConcurrentWrites(b *testing.B) {
+	router := setupRouter(raftNode)
+	var counter uint64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := fmt.Sprintf("bench-%d", atomic.AddUint64(&counter, 1))
+			w := performRequest(router, "POST", "/keys/"+key+"/", strings.NewReader(`{"value": "bench"}`))
+			if w.Code != http.StatusOK {
+				b.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+			}
+		}
+	})
+}
+
+func TestBulkViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+	raftNode.Set("test-bulk-c", "old")
+
+	type bulkResponse struct {
+		Index   uint64 `json:"index"`
+		Errors  bool   `json:"errors"`
+		Results []struct {
+			Op      string `json:"op"`
+			Key     string `json:"key"`
+			Index   uint64 `json:"index"`
+			Deleted bool   `json:"deleted"`
+			Code    string `json:"code"`
+		} `json:"results"`
+	}
+
+	body := `{"op": "set", "key": "test-bulk-a", "value": "1"}
+{"op": "set", "key": "test-bulk-b", "value": "2", "ttl": "1m"}
+{"op": "delete", "key": "test-bulk-c"}
+{"op": "delete", "key": "test-bulk-missing"}
+`
+	w := performRequest(router, "POST", "/keys/_bulk/", strings.NewReader(body))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	var response bulkResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.False(t, response.Errors)
+	assert.Len(t, response.Results, 4)
+	assert.Equal(t, "test-bulk-c", response.Results[2].Key)
+	assert.True(t, response.Results[2].Deleted)
+	assert.False(t, response.Results[3].Deleted)
+	assert.Equal(t, response.Index, response.Results[0].Index)
+	assert.Equal(t, w.Header().Get("X-Raft-Index"), strconv.FormatUint(response.Index, 10))
+	value, _ := raftNode.Get("test-bulk-b")
+	assert.Equal(t, "2", value)
+	_, exists := raftNode.Get("test-bulk-c")
+	assert.False(t, exists)
+
+	// a lease which doesn't exist fails only its operation
+	body = `[{"op": "set", "key": "test-bulk-a", "value": "3"}, {"op": "set", "key": "test-bulk-d", "value": "4", "lease": 100000}]`
+	w = performRequest(router, "POST", "/keys/_bulk/", strings.NewReader(body))
+	response = bulkResponse{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.True(t, response.Errors)
+	assert.Equal(t, "", response.Results[0].Code)
+	assert.Equal(t, "lease_not_found", response.Results[1].Code)
+	value, _ = raftNode.Get("test-bulk-a")
+	assert.Equal(t, "3", value)
+
+	// and the whole atomic bulk write
+	body = `[{"op": "set", "key": "test-bulk-a", "value": "5"}, {"op": "set", "key": "test-bulk-d", "value": "6", "lease": 100000}]`
+	w = performRequest(router, "POST", "/keys/_bulk/?atomic=true", strings.NewReader(body))
+	response = bulkResponse{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.True(t, response.Errors)
+	assert.Equal(t, "aborted", response.Results[0].Code)
+	assert.Equal(t, "lease_not_found", response.Results[1].Code)
+	value, _ = raftNode.Get("test-bulk-a")
+	assert.Equal(t, "3", value, "Atomic bulk write must not be applied partially")
+
+	w = performRequest(router, "POST", "/keys/_bulk/", strings.NewReader(`[{"op": "get", "key": "a"}]`))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400")
+	w = performRequest(router, "POST", "/keys/_bulk/", strings.NewReader(`{"op": "set"`))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400")
+	w = performRequest(router, "POST", "/keys/_bulk/", strings.NewReader(""))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400")
+}
+
+func TestJoinViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+
+	// the leader is already in the cluster with this ID and address
+	w := performRequest(router, "POST", "/cluster/join/", strings.NewReader(`{"id": "127.0.0.1:6666", "address": "127.0.0.1:6666"}`))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	servers, _ := raftNode.GetClusterServers()
+	assert.Equal(t, raft.ServerID("127.0.0.1:6666"), servers[0].ID)
+
+	w = performRequest(router, "POST", "/cluster/join/", strings.NewReader(`{"id": "node"}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Response code should be 400")
+
+	// the node rejoins from a new address
+	w = performRequest(router, "POST", "/cluster/join/", strings.NewReader(`{"id": "test-moving-node", "address": "127.0.0.1:6671", "role": "nonvoter"}`))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	defer raftNode.RemoveServer("test-moving-node")
+	w = performRequest(router, "POST", "/cluster/join/", strings.NewReader(`{"id": "test-moving-node", "address": "127.0.0.1:6672", "role": "nonvoter"}`))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	assert.Equal(t, []raft.ServerAddress{"127.0.0.1:6672"}, serverAddresses("test-moving-node"), "Address must be updated")
+
+	// another node can't take the address
+	w = performRequest(router, "POST", "/cluster/join/", strings.NewReader(`{"id": "test-other-node", "address": "127.0.0.1:6672", "role": "nonvoter"}`))
+	assert.Equal(t, http.StatusConflict, w.Code, "Response code should be 409")
+	assert.Contains(t, w.Body.String(), "address_in_use")
+	assert.Equal(t, []raft.ServerAddress{"127.0.0.1:6672"}, serverAddresses("test-moving-node"))
+	assert.Empty(t, serverAddresses("test-other-node"))
+}
+
+// serverAddresses returns addresses of the servers of the cluster with the ID
+func serverAddresses(id string) []raft.ServerAddress {
+	var addresses []raft.ServerAddress
+	servers, _ := raftNode.GetClusterServers()
+	for _, server := range servers {
+		if server.ID == raft.ServerID(id) {
+			addresses = append(addresses, server.Address)
+		}
+	}
+	return addresses
+}
+
+func TestRemoveServerViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+
+	w := performRequest(router, "DELETE", "/cluster/servers/unknown-node/", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, "Response code should be 404")
+
+	// the leader is the only voter
+	w = performRequest(router, "DELETE", "/cluster/servers/127.0.0.1:6666/", nil)
+	assert.Equal(t, http.StatusConflict, w.Code, "Response code should be 409")
+	assert.Contains(t, w.Body.String(), "min_voters")
+
+	// a non-voter doesn't affect the quorum, so it can be added and removed
+	future := raftNode.RaftNode.AddNonvoter("test-removed-node", "127.0.0.1:6999", 0, 0)
+	assert.Nil(t, future.Error())
+	w = performRequest(router, "DELETE", "/cluster/servers/test-removed-node/", nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	servers, _ := raftNode.GetClusterServers()
+	for _, server := range servers {
+		assert.NotEqual(t, raft.ServerID("test-removed-node"), server.ID, "Server must be removed")
+	}
+}
+
+func TestClusterStatusViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+	future := raftNode.RaftNode.AddNonvoter("test-status-node", "127.0.0.1:6998", 0, 0)
+	assert.Nil(t, future.Error())
+	defer func() {
+		_, err := raftNode.RemoveServer("test-status-node")
+		assert.Nil(t, err, "Can't remove the server")
+	}()
+
+	// the leader keeps writing in the background, e.g. deletes expired keys
+	indexBefore := raftNode.AppliedIndex()
+	w := performRequest(router, "GET", "/cluster/", nil)
+	indexAfter := raftNode.AppliedIndex()
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+	var response struct {
+		Leader  string         `json:"leader"`
+		Servers []serverStatus `json:"servers"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "127.0.0.1:6666", response.Leader)
+	servers := map[string]serverStatus{}
+	for _, server := range response.Servers {
+		servers[server.ID] = server
+	}
+
+	leader := servers["127.0.0.1:6666"]
+	assert.Equal(t, "Voter", leader.Suffrage)
+	assert.True(t, leader.Leader)
+	assert.Equal(t, "Leader", leader.State)
+	assert.True(t, indexBefore <= leader.AppliedIndex && leader.AppliedIndex <= indexAfter,
+		"Applied index %d must be between %d and %d", leader.AppliedIndex, indexBefore, indexAfter)
+	assert.NotEmpty(t, leader.Stats["term"])
+	assert.NotEmpty(t, leader.Stats["last_log_index"])
+	assert.Empty(t, leader.Error)
+
+	// the node isn't running, so only its membership is known
+	ghost, ok := servers["test-status-node"]
+	assert.True(t, ok, "All servers must be listed")
+	assert.Equal(t, "127.0.0.1:6998", ghost.Address)
+	assert.Equal(t, "Nonvoter", ghost.Suffrage)
+	assert.False(t, ghost.Leader)
+	assert.Empty(t, ghost.State)
+	assert.NotEmpty(t, ghost.Error)
+}
+
 func init() {
 	raftNode = getLeaderNode()
 }
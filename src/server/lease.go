@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/alexander-akhmetov/raft-example/src/node"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+type grantLeaseData struct {
+	// TTL is a duration after which the lease expires unless it is kept alive, e.g. "10s"
+	TTL string `json:"ttl"`
+}
+
+// leaseResponse returns the lease as a JSON object
+func leaseResponse(lease node.Lease) gin.H {
+	return gin.H{
+		"id":         lease.ID,
+		"ttl":        lease.TTL.String(),
+		"expires_in": time.Until(time.Unix(0, lease.ExpiresAt)).String(),
+	}
+}
+
+// parseLeaseID reads the lease ID from the URL
+// returns false if the ID is invalid, the error is already written to the response
+func parseLeaseID(c *gin.Context) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		badRequestResponse(c, "invalid_lease", fmt.Errorf("Invalid lease ID: %s", c.Param("id")))
+		return 0, false
+	}
+	return id, true
+}
+
+// grantLeaseView creates a new lease: POST /leases/ {"ttl": "10s"}
+// keys are attached to the lease with {"lease": <id>} in POST /keys/<key>/
+func grantLeaseView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		var data grantLeaseData
+		if err := c.ShouldBindWith(&data, binding.JSON); err != nil {
+			badRequestResponse(c, "invalid_request", err)
+			return
+		}
+		ttl, err := time.ParseDuration(data.TTL)
+		if err != nil || ttl <= 0 {
+			badRequestResponse(c, "invalid_ttl", fmt.Errorf("Invalid ttl: %s", data.TTL))
+			return
+		}
+
+		lease, index, err := storage.GrantLease(ttl)
+		if err != nil {
+			errorResponse(c, err)
+			return
+		}
+		writeResponse(c, index, leaseResponse(lease))
+	}
+	return view
+}
+
+// getLeaseView returns the lease with keys attached to it
+func getLeaseView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		id, ok := parseLeaseID(c)
+		if !ok || !prepareRead(c, storage) {
+			return
+		}
+
+		lease, keys, exists := storage.GetLease(id)
+		if !exists {
+			errorResponse(c, node.ErrLeaseNotFound)
+			return
+		}
+		response := leaseResponse(lease)
+		response["keys"] = keys
+		c.JSON(200, response)
+	}
+	return view
+}
+
+// keepAliveLeaseView renews the lease, it expires after its TTL from now
+func keepAliveLeaseView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		id, ok := parseLeaseID(c)
+		if !ok {
+			return
+		}
+
+		lease, index, err := storage.KeepAliveLease(id)
+		if err != nil {
+			errorResponse(c, err)
+			return
+		}
+		writeResponse(c, index, leaseResponse(lease))
+	}
+	return view
+}
+
+// revokeLeaseView deletes the lease and all keys attached to it
+func revokeLeaseView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		id, ok := parseLeaseID(c)
+		if !ok {
+			return
+		}
+
+		deleted, index, err := storage.RevokeLease(id)
+		if err != nil {
+			errorResponse(c, err)
+			return
+		}
+		writeResponse(c, index, gin.H{
+			"revoked":      true,
+			"deleted_keys": deleted,
+		})
+	}
+	return view
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alexander-akhmetov/raft-example/src/node"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+type acquireLockData struct {
+	Lease uint64 `json:"lease"`
+	Owner string `json:"owner"`
+}
+
+type releaseLockData struct {
+	Token uint64 `json:"token"`
+}
+
+// lockResponse returns the lock holder as a JSON object
+func lockResponse(name string, holder node.LockHolder) gin.H {
+	return gin.H{
+		"name":  name,
+		"owner": holder.Owner,
+		"lease": holder.Lease,
+		"token": holder.Token,
+	}
+}
+
+// acquireLockView acquires the lock for the lease:
+// POST /locks/<name>/acquire/?wait=10s {"lease": <id>, "owner": "worker-1"}
+// without "wait" it returns 409 immediately if the lock is held by another lease
+func acquireLockView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		name := c.Param("name")
+		var data acquireLockData
+		if err := c.ShouldBindWith(&data, binding.JSON); err != nil {
+			badRequestResponse(c, "invalid_request", err)
+			return
+		}
+		if data.Lease == 0 {
+			badRequestResponse(c, "invalid_lease", fmt.Errorf("Lock requires a lease"))
+			return
+		}
+
+		var wait time.Duration
+		if value := c.Query("wait"); value != "" {
+			var err error
+			wait, err = time.ParseDuration(value)
+			if err != nil || wait <= 0 {
+				badRequestResponse(c, "invalid_wait", fmt.Errorf("Invalid wait: %s", value))
+				return
+			}
+			if wait > maxBlockingWait {
+				wait = maxBlockingWait
+			}
+		}
+
+		holder, err := storage.AcquireLock(name, data.Lease, data.Owner, c.Request.Context().Done(), wait)
+		if err == node.ErrLockHeld {
+			status, code := errorStatus(err)
+			response := lockResponse(name, holder)
+			response["code"] = code
+			response["error"] = fmt.Sprintf("%+v", err)
+			c.JSON(status, response)
+			return
+		}
+		if err != nil {
+			errorResponse(c, err)
+			return
+		}
+		writeResponse(c, holder.Token, lockResponse(name, holder))
+	}
+	return view
+}
+
+// releaseLockView releases the lock: POST /locks/<name>/release/ {"token": <token>}
+func releaseLockView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		var data releaseLockData
+		if err := c.ShouldBindWith(&data, binding.JSON); err != nil {
+			badRequestResponse(c, "invalid_request", err)
+			return
+		}
+
+		index, err := storage.ReleaseLock(c.Param("name"), data.Token)
+		if err != nil {
+			errorResponse(c, err)
+			return
+		}
+		writeResponse(c, index, gin.H{"released": true})
+	}
+	return view
+}
+
+// getLockView returns the current holder of the lock
+func getLockView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		name := c.Param("name")
+		if !prepareRead(c, storage) {
+			return
+		}
+
+		holder, held := storage.GetLockHolder(name)
+		if !held {
+			c.JSON(404, gin.H{
+				"code":  "lock_not_held",
+				"error": "Lock is not held",
+			})
+			return
+		}
+		c.JSON(200, lockResponse(name, holder))
+	}
+	return view
+}
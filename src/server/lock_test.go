@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alexander-akhmetov/raft-example/src/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocksViaHTTP(t *testing.T) {
+	router := setupRouter(raftNode)
+	firstLease, _, err := raftNode.GrantLease(time.Minute)
+	assert.Nil(t, err, "Can't grant a lease")
+	secondLease, _, err := raftNode.GrantLease(time.Minute)
+	assert.Nil(t, err, "Can't grant a lease")
+
+	type lockResponse struct {
+		Code  string `json:"code"`
+		Owner string `json:"owner"`
+		Lease uint64 `json:"lease"`
+		Token uint64 `json:"token"`
+	}
+	acquire := func(lease uint64, owner string, query string) (int, lockResponse) {
+		body := fmt.Sprintf(`{"lease": %d, "owner": "%s"}`, lease, owner)
+		w := performRequest(router, "POST", "/locks/test-lock/acquire/"+query, bytes.NewBufferString(body))
+		var response lockResponse
+		json.Unmarshal([]byte(w.Body.String()), &response)
+		return w.Code, response
+	}
+
+	status, first := acquire(firstLease.ID, "first", "")
+	assert.Equal(t, http.StatusOK, status, "Response code should be 200")
+	assert.Equal(t, "first", first.Owner)
+	assert.NotZero(t, first.Token)
+
+	status, again := acquire(firstLease.ID, "first", "")
+	assert.Equal(t, http.StatusOK, status, "The same lease must be able to acquire the lock again")
+	assert.Equal(t, first.Token, again.Token)
+
+	status, held := acquire(secondLease.ID, "second", "?wait=10ms")
+	assert.Equal(t, http.StatusConflict, status, "Response code should be 409")
+	assert.Equal(t, "lock_held", held.Code)
+	assert.Equal(t, "first", held.Owner, "Response must contain the current holder")
+
+	w := performRequest(router, "GET", "/locks/test-lock/", nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+
+	// the waiting acquisition gets the lock when the first lease is revoked
+	done := make(chan lockResponse)
+	go func() {
+		_, second := acquire(secondLease.ID, "second", "?wait=5s")
+		done <- second
+	}()
+	time.Sleep(time.Millisecond * 50)
+	_, _, err = raftNode.RevokeLease(firstLease.ID)
+	assert.Nil(t, err, "Can't revoke the lease")
+	second := <-done
+	assert.Equal(t, "second", second.Owner)
+	assert.True(t, second.Token > first.Token, "Fencing token must increase")
+
+	w = performRequest(router, "POST", "/locks/test-lock/release/", bytes.NewBufferString(fmt.Sprintf(`{"token": %d}`, first.Token)))
+	assert.Equal(t, http.StatusConflict, w.Code, "Stale token must not release the lock")
+	w = performRequest(router, "POST", "/locks/test-lock/release/", bytes.NewBufferString(fmt.Sprintf(`{"token": %d}`, second.Token)))
+	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
+
+	w = performRequest(router, "GET", "/locks/test-lock/", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, "Response code should be 404")
+	status, _ = acquire(0, "nobody", "")
+	assert.Equal(t, http.StatusBadRequest, status, "Response code should be 400")
+}
+
+func TestLockClient(t *testing.T) {
+	server := httptest.NewServer(setupRouter(raftNode))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	c := client.NewClient(serverURL.Host)
+
+	first, err := client.NewSession(c, time.Second*3)
+	assert.Nil(t, err, "Can't start a session")
+	second, err := client.NewSession(c, time.Second*3)
+	assert.Nil(t, err, "Can't start a session")
+	defer second.Close()
+
+	lock, err := first.Lock("client-lock", "first", 0)
+	assert.Nil(t, err, "Can't acquire the lock")
+	assert.NotZero(t, lock.Token)
+
+	_, err = second.Lock("client-lock", "second", time.Millisecond*10)
+	apiErr, ok := err.(*client.Error)
+	assert.True(t, ok, "API errors must be returned as *client.Error")
+	assert.Equal(t, "lock_held", apiErr.Code)
+
+	// closing the session revokes its lease and releases the lock
+	assert.Nil(t, first.Close())
+	_, ok = <-first.Done()
+	assert.False(t, ok)
+
+	lock, err = second.Lock("client-lock", "second", time.Second)
+	assert.Nil(t, err, "Lock must be released with the session")
+	assert.Nil(t, c.ReleaseLock(lock))
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexander-akhmetov/raft-example/src/node"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// watchKeepAlive is how often a "ping" event is sent when there are no changes,
+// so clients and proxies don't close an idle stream
+var watchKeepAlive = time.Second * 15
+
+// watchView streams changes of keys as Server-Sent Events:
+// GET /watch/?prefix=app/&from_index=N
+// every event has "<index>.<seq>" id, one Raft log entry may change many keys,
+// so the client resumes with "?from_id=<last id>" or the Last-Event-ID header.
+// Watches are served by the local node and are never forwarded to the leader.
+func watchView(storage *node.RStorage) func(*gin.Context) {
+	view := func(c *gin.Context) {
+		var watcher *node.Watcher
+		var err error
+		lastID := c.Query("from_id")
+		if lastID == "" {
+			// the vendored gin doesn't canonicalize header names in GetHeader
+			lastID = c.Request.Header.Get("Last-Event-ID")
+		}
+		if lastID != "" {
+			index, seq, parseErr := parseEventID(lastID)
+			if parseErr != nil {
+				badRequestResponse(c, "invalid_index", parseErr)
+				return
+			}
+			watcher, err = storage.WatchAfter(c.Query("prefix"), index, seq)
+		} else {
+			var fromIndex uint64
+			if value := c.Query("from_index"); value != "" {
+				index, parseErr := strconv.ParseUint(value, 10, 64)
+				if parseErr != nil {
+					badRequestResponse(c, "invalid_index", fmt.Errorf("Invalid from_index: %s", value))
+					return
+				}
+				fromIndex = index
+			}
+			watcher, err = storage.Watch(c.Query("prefix"), fromIndex)
+		}
+		if err != nil {
+			c.Header("X-Raft-Index", strconv.FormatUint(storage.AppliedIndex(), 10))
+			errorResponse(c, err)
+			return
+		}
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Raft-Index", strconv.FormatUint(watcher.Index(), 10))
+		c.Status(200)
+
+		cancel := c.Request.Context().Done()
+		c.Stream(func(w io.Writer) bool {
+			events, err := watcher.Next(cancel, watchKeepAlive)
+			if err != nil {
+				status, code := errorStatus(err)
+				log.Printf("[DEBUG] Watch is stopped with %d %s: %+v", status, code, err)
+				sse.Encode(w, sse.Event{
+					Event: "error",
+					Data: gin.H{
+						"code":  code,
+						"error": fmt.Sprintf("%+v", err),
+						"index": storage.AppliedIndex(),
+					},
+				})
+				return false
+			}
+
+			if len(events) == 0 {
+				select {
+				case <-cancel:
+					return false
+				default:
+				}
+				return sse.Encode(w, sse.Event{Event: "ping", Data: gin.H{"index": watcher.Index()}}) == nil
+			}
+
+			for _, event := range events {
+				err := sse.Encode(w, sse.Event{
+					Id:    formatEventID(event),
+					Event: event.Type,
+					Data:  event,
+				})
+				if err != nil {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	return view
+}
+
+// formatEventID returns the id of the event in the stream: "<index>.<seq>"
+func formatEventID(event node.WatchEvent) string {
+	return fmt.Sprintf("%d.%d", event.Index, event.Seq)
+}
+
+// parseEventID parses an id returned by formatEventID
+func parseEventID(id string) (uint64, int, error) {
+	parts := strings.SplitN(id, ".", 2)
+	if len(parts) == 2 {
+		index, indexErr := strconv.ParseUint(parts[0], 10, 64)
+		seq, seqErr := strconv.Atoi(parts[1])
+		if indexErr == nil && seqErr == nil && index > 0 && seq >= 0 {
+			return index, seq, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("Invalid event id: %s", id)
+}